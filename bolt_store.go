@@ -0,0 +1,397 @@
+package influxdb
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// seriesValuesBucket and metaBucket are the top-level BoltDB buckets used
+// by boltShardStore.
+var (
+	seriesValuesBucket = []byte("values")
+	metaBucket         = []byte("meta")
+)
+
+// boltShardStore is the original ShardStore implementation, backed by a
+// single BoltDB file. It favors read locality and crash-safety over raw
+// write throughput, so it's the right choice for shards with long
+// retention and a low write rate.
+type boltShardStore struct {
+	// mu guards db itself, not what goes on inside a transaction: BoltDB
+	// already serializes its own writers and lets readers run concurrent
+	// with them. What it can't survive is Restore swapping db out from
+	// under an in-flight Update/View — a real possibility once several
+	// write pipeline workers can be mid-commit when a snapshot chunk
+	// arrives. Every method that touches db holds mu (RLock if it's only
+	// reading the *bolt.DB value, Lock if it's replacing it) for its whole
+	// call, so Restore can't swap db while another method is using it.
+	mu sync.RWMutex
+	db *bolt.DB
+}
+
+// newBoltShardStore returns a new, unopened boltShardStore.
+func newBoltShardStore() *boltShardStore {
+	return &boltShardStore{}
+}
+
+func (s *boltShardStore) Open(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	s.db = db
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(seriesValuesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+}
+
+func (s *boltShardStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *boltShardStore) Update(fn func(tx ShardTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltShardTx{tx: tx})
+	})
+}
+
+func (s *boltShardStore) View(fn func(tx ShardTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltShardTx{tx: tx})
+	})
+}
+
+// Snapshot writes a consistent dump of the database to w by streaming the
+// raw page data out of a read transaction, the same mechanism BoltDB's own
+// backup support uses.
+func (s *boltShardStore) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// Restore atomically replaces the database file with the dump read from
+// r: the dump is written to a temporary file alongside the current
+// database, then opened and validated as a real BoltDB file there, and
+// only once that succeeds is it renamed over the live file and reopened
+// in place. A corrupt, truncated, or otherwise malformed snapshot (an
+// entirely plausible arrival over the peer catch-up path) is caught
+// before the live file is touched, so rejecting one never leaves the
+// shard without a usable store. It holds mu for its entire body, so no
+// Update/View/Snapshot call can be using s.db while it's closed, renamed
+// out from under, and reopened.
+func (s *boltShardStore) Restore(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.db.Path()
+	tmpPath := path + ".restore"
+
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	// Validate the restored bytes are actually a valid BoltDB file before
+	// touching the live one: bolt.Open refusing tmpPath only costs us the
+	// temp file, whereas discovering the same failure after closing and
+	// renaming over the live db would destroy it.
+	validate, err := bolt.Open(tmpPath, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := validate.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := s.db.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// boltBucketCacheSize bounds the number of series buckets a boltShardTx
+// keeps a handle to, so a transaction touching many series doesn't grow
+// the cache unbounded.
+const boltBucketCacheSize = 32
+
+// boltBucketCache is an LRU of recently-written series bucket handles,
+// scoped to a single transaction. BoltDB bucket handles are only valid for
+// the transaction that produced them, so the cache never outlives a
+// boltShardTx.
+type boltBucketCache struct {
+	buckets map[uint32]*bolt.Bucket
+	order   []uint32 // oldest first
+}
+
+func newBoltBucketCache() *boltBucketCache {
+	return &boltBucketCache{buckets: make(map[uint32]*bolt.Bucket)}
+}
+
+func (c *boltBucketCache) get(seriesID uint32) (*bolt.Bucket, bool) {
+	b, ok := c.buckets[seriesID]
+	if ok {
+		c.touch(seriesID)
+	}
+	return b, ok
+}
+
+func (c *boltBucketCache) put(seriesID uint32, b *bolt.Bucket) {
+	if _, ok := c.buckets[seriesID]; !ok && len(c.buckets) >= boltBucketCacheSize {
+		evict := c.order[0]
+		c.order = c.order[1:]
+		delete(c.buckets, evict)
+	}
+	c.buckets[seriesID] = b
+	c.touch(seriesID)
+}
+
+func (c *boltBucketCache) touch(seriesID uint32) {
+	for i, id := range c.order {
+		if id == seriesID {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, seriesID)
+}
+
+// boltShardTx adapts a *bolt.Tx to the ShardTx interface. Each series gets
+// its own bucket, named by its big-endian seriesID, with points keyed by
+// big-endian timestamp within that bucket.
+type boltShardTx struct {
+	tx      *bolt.Tx
+	buckets *boltBucketCache // lazily initialized; write path only
+}
+
+// bucket returns seriesID's bucket, creating it if necessary, consulting
+// and populating the transaction's bucket cache so repeated writes to the
+// same series within one Update don't re-resolve it from the tx each time.
+func (t *boltShardTx) bucket(seriesID uint32) (*bolt.Bucket, error) {
+	if t.buckets == nil {
+		t.buckets = newBoltBucketCache()
+	}
+	if b, ok := t.buckets.get(seriesID); ok {
+		return b, nil
+	}
+
+	b, err := t.tx.CreateBucketIfNotExists(u32tob(seriesID))
+	if err != nil {
+		return nil, err
+	}
+	t.buckets.put(seriesID, b)
+	return b, nil
+}
+
+func (t *boltShardTx) PutSeriesPoint(seriesID uint32, timestamp int64, data []byte) error {
+	b, err := t.bucket(seriesID)
+	if err != nil {
+		return err
+	}
+	return b.Put(u64tob(uint64(timestamp)), data)
+}
+
+func (t *boltShardTx) PutSeriesPoints(seriesID uint32, points []ShardWriteOp) error {
+	b, err := t.bucket(seriesID)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range points {
+		key := u64tob(uint64(p.Timestamp))
+		if p.Tombstone {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.Put(key, p.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltShardTx) GetSeriesPoint(seriesID uint32, timestamp int64) ([]byte, error) {
+	b := t.tx.Bucket(u32tob(seriesID))
+	if b == nil {
+		return nil, nil
+	}
+	return b.Get(u64tob(uint64(timestamp))), nil
+}
+
+func (t *boltShardTx) DeleteSeries(seriesID uint32) error {
+	err := t.tx.DeleteBucket(u32tob(seriesID))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+func (t *boltShardTx) DeleteSeriesPoint(seriesID uint32, timestamp int64) error {
+	b := t.tx.Bucket(u32tob(seriesID))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(u64tob(uint64(timestamp)))
+}
+
+func (t *boltShardTx) MetaGet(key string) ([]byte, error) {
+	return t.tx.Bucket(metaBucket).Get([]byte(key)), nil
+}
+
+func (t *boltShardTx) MetaPut(key string, value []byte) error {
+	return t.tx.Bucket(metaBucket).Put([]byte(key), value)
+}
+
+// isSeriesBucket reports whether name is a per-series bucket rather than
+// one of the store's reserved top-level buckets.
+func isSeriesBucket(name []byte) bool {
+	return len(name) == 4 && string(name) != string(seriesValuesBucket) && string(name) != string(metaBucket)
+}
+
+// SeriesIDs returns the set of series currently stored, implementing
+// ShardStoreStats.
+func (s *boltShardStore) SeriesIDs() ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var ids []uint32
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if isSeriesBucket(name) {
+				ids = append(ids, btou32(name))
+			}
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// SeriesSize returns the approximate number of bytes stored for seriesID,
+// implementing ShardStoreStats.
+func (s *boltShardStore) SeriesSize(seriesID uint32) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(u32tob(seriesID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			size += int64(len(k) + len(v))
+			return nil
+		})
+	})
+	return size, err
+}
+
+// SeriesPoints returns every stored, raw point for seriesID keyed by
+// timestamp, implementing ShardStoreStats.
+func (s *boltShardStore) SeriesPoints(seriesID uint32) (map[int64][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	points := make(map[int64][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(u32tob(seriesID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			points[int64(btou64(k))] = append([]byte(nil), v...)
+			return nil
+		})
+	})
+	return points, err
+}
+
+// RewriteSeries rewrites seriesID's bucket in place, implementing
+// ShardStoreStats. BoltDB buckets fragment as entries are added and
+// removed over time; recreating the bucket from its current contents
+// compacts it back down to a dense, append-ordered layout.
+func (s *boltShardStore) RewriteSeries(seriesID uint32) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		name := u32tob(seriesID)
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+
+		entries := make(map[string][]byte)
+		if err := b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append([]byte(nil), v...)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+		nb, err := tx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		for k, v := range entries {
+			if err := nb.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
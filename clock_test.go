@@ -0,0 +1,35 @@
+package influxdb
+
+import "time"
+
+// mockClock is a Clock whose Now only advances when the test tells it to,
+// so enforcement loops can be driven deterministically instead of waiting
+// on real time.
+type mockClock struct {
+	now  time.Time
+	tick chan time.Time
+}
+
+// newMockClock returns a mockClock starting at now.
+func newMockClock(now time.Time) *mockClock {
+	return &mockClock{now: now, tick: make(chan time.Time, 1)}
+}
+
+func (c *mockClock) Now() time.Time { return c.now }
+
+func (c *mockClock) Tick(d time.Duration) Ticker { return mockTicker{c.tick} }
+
+// mockTicker adapts mockClock's channel to the Ticker interface. Stop is a
+// no-op: the channel is owned by the mockClock, not the ticker, and tests
+// drive it directly via Advance.
+type mockTicker struct{ ch chan time.Time }
+
+func (t mockTicker) C() <-chan time.Time { return t.ch }
+func (t mockTicker) Stop()               {}
+
+// Advance moves the clock forward by d and pushes the new time onto the
+// tick channel, simulating a real ticker firing once.
+func (c *mockClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.tick <- c.now
+}
@@ -0,0 +1,856 @@
+package influxdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// LSM tunables, named instead of being buried as inline literals; a shard
+// overrides them through its own ShardStoreConfig.LSM. Names and defaults intentionally mirror
+// Badger's MemTableSize/ValueThreshold options.
+const (
+	// DefaultLSMMemTableSize is the size, in bytes, a memtable is allowed to
+	// grow to before it's flushed to a segment file.
+	DefaultLSMMemTableSize = 64 << 20 // 64MB
+
+	// DefaultLSMValueThreshold is the payload size, in bytes, at or above
+	// which a value is written to the value log instead of inline in the
+	// LSM segment.
+	DefaultLSMValueThreshold = 1 << 10 // 1KB
+
+	// smallMemTableSize is the cutoff at or below which a configured memtable is
+	// considered "small" for the purposes of auto-tuning ValueThreshold.
+	smallMemTableSize = 8 << 20 // 8MB
+
+	// smallValueThreshold replaces ValueThreshold when the memtable is
+	// small: point payloads in a shard are usually only tens of bytes, so
+	// routing them through the value log (meant for large blobs) just adds
+	// an extra indirection and hurts compaction locality.
+	smallValueThreshold = 64 // bytes
+)
+
+// LSMOptions holds the tunables for the LSM-backed ShardStore.
+type LSMOptions struct {
+	// MemTableSize is the size, in bytes, a memtable may reach before it is
+	// flushed to a segment.
+	MemTableSize int64
+
+	// ValueThreshold is the payload size, in bytes, at or above which a
+	// value is written to the value log and only a reference to it kept in
+	// the memtable/segments, rather than storing the payload inline.
+	ValueThreshold int
+}
+
+// NewLSMOptions returns the default LSM tunables, with ValueThreshold
+// already adjusted for a small MemTableSize.
+func NewLSMOptions() LSMOptions {
+	opts := LSMOptions{
+		MemTableSize:   DefaultLSMMemTableSize,
+		ValueThreshold: DefaultLSMValueThreshold,
+	}
+	opts.autoTuneValueThreshold()
+	return opts
+}
+
+// autoTuneValueThreshold lowers ValueThreshold when MemTableSize is small,
+// so small time-series payloads stay in the LSM rather than the value log.
+func (o *LSMOptions) autoTuneValueThreshold() {
+	if o.MemTableSize <= smallMemTableSize && o.ValueThreshold > smallValueThreshold {
+		o.ValueThreshold = smallValueThreshold
+	}
+}
+
+// lsmLogEntryKind tags what a commit log entry represents, so replay knows
+// how to apply it.
+type lsmLogEntryKind uint8
+
+const (
+	// lsmLogEntryPoint is a single series point, put or tombstoned
+	// depending on lsmRecord.tombstone.
+	lsmLogEntryPoint lsmLogEntryKind = iota
+
+	// lsmLogEntryMeta is a shard-level metadata key/value pair.
+	lsmLogEntryMeta
+
+	// lsmLogEntryDeleteSeries drops every point stored for a seriesID,
+	// regardless of which timestamps it was written at. It's distinct
+	// from lsmLogEntryPoint because a single per-point tombstone can't
+	// express "every timestamp this series will ever have had", which is
+	// exactly what DeleteSeries needs replay to reconstruct.
+	lsmLogEntryDeleteSeries
+)
+
+// lsmRecord is a single series point held in the memtable.
+type lsmRecord struct {
+	seriesID  uint32
+	timestamp int64
+	data      []byte
+	tombstone bool
+
+	// valueRef is set instead of data when the payload was routed to the
+	// value log for being at or above opt.ValueThreshold; data is nil in
+	// that case and the payload is fetched from the value log on read.
+	valueRef *lsmValueRef
+}
+
+func (r *lsmRecord) size() int64 {
+	if r.valueRef != nil {
+		return int64(4 + 8 + lsmValueRefSize)
+	}
+	return int64(4 + 8 + len(r.data))
+}
+
+// lsmValueRef locates a payload that was routed to the value log rather
+// than stored inline in the memtable/segments.
+type lsmValueRef struct {
+	offset int64
+	length int64
+}
+
+// lsmValueRefSize is the in-memory footprint charged against memSize for a
+// record stored by reference instead of inline, standing in for the
+// offset/length pair rather than the full payload.
+const lsmValueRefSize = 16
+
+// lsmValueLogSuffix names the file a shard's out-of-line payloads are
+// appended to, alongside its commit log.
+const lsmValueLogSuffix = ".vlog"
+
+// lsmShardStore is an LSM-tree ShardStore tuned for write-heavy workloads:
+// writes land in an in-memory memtable and are appended to a commit log for
+// durability; the memtable is periodically flushed to an immutable segment
+// once it passes opt.MemTableSize. It trades the read locality of
+// boltShardStore for cheaper, append-only writes. Payloads at or above
+// opt.ValueThreshold are appended to a separate value log file instead of
+// being stored inline, so the memtable/segments hold only a small
+// offset/length reference for them; this keeps large payloads from
+// bloating the structures the write and compaction paths walk most often.
+type lsmShardStore struct {
+	opt LSMOptions
+
+	mu       sync.RWMutex
+	meta     map[string][]byte
+	mem      map[uint32]map[int64]*lsmRecord // active memtable
+	memSize  int64
+	segments []map[uint32]map[int64]*lsmRecord // flushed, immutable
+
+	path     string
+	log      *os.File
+	valueLog *os.File
+}
+
+// newLSMShardStore returns a new, unopened lsmShardStore using opt.
+func newLSMShardStore(opt LSMOptions) *lsmShardStore {
+	opt.autoTuneValueThreshold()
+	return &lsmShardStore{
+		opt:  opt,
+		meta: make(map[string][]byte),
+		mem:  make(map[uint32]map[int64]*lsmRecord),
+	}
+}
+
+func (s *lsmShardStore) Open(path string) error {
+	s.path = path
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.log = f
+
+	vf, err := os.OpenFile(path+lsmValueLogSuffix, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.valueLog = vf
+
+	return s.replay()
+}
+
+// replay rebuilds the in-memory state from the commit log on startup.
+func (s *lsmShardStore) replay() error {
+	r := bufio.NewReader(s.log)
+	for {
+		rec, kind, metaKey, err := readLSMLogEntry(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch kind {
+		case lsmLogEntryMeta:
+			s.meta[metaKey] = rec.data
+		case lsmLogEntryDeleteSeries:
+			// Drop every point seen for this series so far; any put for
+			// it later in the log (there shouldn't be any after a
+			// DeleteSeries, but replay is replaying history, not
+			// re-validating it) will recreate the bucket as usual.
+			delete(s.mem, rec.seriesID)
+		default:
+			// rec's placement (inline vs. value-log reference) was already
+			// decided and recorded by route when this entry was first
+			// written, so replay just reinstates it rather than routing
+			// again — routing again here would re-append the payload to
+			// the value log on every single restart, growing it without
+			// bound.
+			s.applyToMemtable(rec)
+		}
+	}
+	return nil
+}
+
+// route decides whether rec's payload belongs inline in the memtable or
+// out-of-line in the value log, based on opt.ValueThreshold, and must be
+// called before rec is appended to the commit log so the entry records
+// the resulting placement (data or valueRef) rather than always the full
+// payload. Calling route on a record that's already been routed would
+// write a second copy of its payload to the value log, so callers must
+// only route a freshly constructed record, never one read back off the
+// commit log.
+func (s *lsmShardStore) route(rec *lsmRecord) error {
+	if rec.tombstone || len(rec.data) < s.opt.ValueThreshold {
+		return nil
+	}
+
+	off, err := s.valueLog.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.valueLog.Write(rec.data); err != nil {
+		return err
+	}
+	rec.valueRef = &lsmValueRef{offset: off, length: int64(len(rec.data))}
+	rec.data = nil
+	return nil
+}
+
+// materialize returns rec's payload, reading it from the value log first
+// if rec was routed out-of-line.
+func (s *lsmShardStore) materialize(rec *lsmRecord) ([]byte, error) {
+	if rec.valueRef == nil {
+		return rec.data, nil
+	}
+	buf := make([]byte, rec.valueRef.length)
+	if _, err := s.valueLog.ReadAt(buf, rec.valueRef.offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *lsmShardStore) applyToMemtable(rec *lsmRecord) {
+	bucket, ok := s.mem[rec.seriesID]
+	if !ok {
+		bucket = make(map[int64]*lsmRecord)
+		s.mem[rec.seriesID] = bucket
+	}
+	bucket[rec.timestamp] = rec
+	s.memSize += rec.size()
+}
+
+// Snapshot writes every meta entry and stored record to w using the same
+// entry format as the commit log, so Restore can read it back with the
+// exact same decoder.
+func (s *lsmShardStore) Snapshot(w io.Writer) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for key, value := range s.meta {
+		if err := appendLSMLogEntry(w, &lsmRecord{data: value}, lsmLogEntryMeta, key); err != nil {
+			return err
+		}
+	}
+	for _, seg := range s.segments {
+		for _, bucket := range seg {
+			for _, rec := range bucket {
+				if err := s.appendMaterializedEntry(w, rec); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, bucket := range s.mem {
+		for _, rec := range bucket {
+			if err := s.appendMaterializedEntry(w, rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// appendMaterializedEntry writes rec to w as a lsmLogEntryPoint, reading
+// its payload from the value log first if it was routed out-of-line, so a
+// snapshot is self-contained regardless of how the source store had
+// routed its records.
+func (s *lsmShardStore) appendMaterializedEntry(w io.Writer, rec *lsmRecord) error {
+	if rec.valueRef == nil {
+		return appendLSMLogEntry(w, rec, lsmLogEntryPoint, "")
+	}
+	data, err := s.materialize(rec)
+	if err != nil {
+		return err
+	}
+	full := &lsmRecord{seriesID: rec.seriesID, timestamp: rec.timestamp, data: data, tombstone: rec.tombstone}
+	return appendLSMLogEntry(w, full, lsmLogEntryPoint, "")
+}
+
+// Restore atomically replaces the store's meta and memtable with the dump
+// read from r, and rewrites the commit log to match so a restart replays
+// exactly this snapshot rather than whatever was on disk before it.
+func (s *lsmShardStore) Restore(r io.Reader) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta := make(map[string][]byte)
+	mem := make(map[uint32]map[int64]*lsmRecord)
+
+	br := bufio.NewReader(r)
+	for {
+		rec, kind, key, err := readLSMLogEntry(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		switch kind {
+		case lsmLogEntryMeta:
+			meta[key] = rec.data
+			continue
+		case lsmLogEntryDeleteSeries:
+			// Snapshot only ever dumps live points, never this kind, but
+			// guard against it anyway rather than storing a bogus record.
+			continue
+		}
+
+		bucket, ok := mem[rec.seriesID]
+		if !ok {
+			bucket = make(map[int64]*lsmRecord)
+			mem[rec.seriesID] = bucket
+		}
+		bucket[rec.timestamp] = rec
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for key, value := range meta {
+		if err := appendLSMLogEntry(s.log, &lsmRecord{data: value}, lsmLogEntryMeta, key); err != nil {
+			return err
+		}
+	}
+
+	s.meta = meta
+	s.mem = mem
+	s.segments = nil
+
+	// Route each record to inline/value-log placement before writing its
+	// commit log entry, the same order putAll uses, so the rewritten log
+	// captures the resulting valueRef directly instead of the full
+	// payload — a later replay of this log then reinstates the same
+	// placement without writing the value log a second time.
+	s.memSize = 0
+	for _, bucket := range mem {
+		for _, rec := range bucket {
+			if err := s.route(rec); err != nil {
+				return err
+			}
+			if err := appendLSMLogEntry(s.log, rec, lsmLogEntryPoint, ""); err != nil {
+				return err
+			}
+			s.memSize += rec.size()
+		}
+	}
+	return nil
+}
+
+func (s *lsmShardStore) Close() error {
+	if s.log == nil {
+		return nil
+	}
+	if s.valueLog != nil {
+		if err := s.valueLog.Close(); err != nil {
+			return err
+		}
+	}
+	return s.log.Close()
+}
+
+func (s *lsmShardStore) Update(fn func(tx ShardTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &lsmShardTx{store: s, writable: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return s.maybeFlush()
+}
+
+func (s *lsmShardStore) View(fn func(tx ShardTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(&lsmShardTx{store: s})
+}
+
+// maybeFlush moves the active memtable into the segment list once it
+// passes opt.MemTableSize, mirroring Badger's memtable-to-sstable flush.
+func (s *lsmShardStore) maybeFlush() error {
+	if s.memSize < s.opt.MemTableSize {
+		return nil
+	}
+
+	s.segments = append(s.segments, s.mem)
+	s.mem = make(map[uint32]map[int64]*lsmRecord)
+	s.memSize = 0
+	return nil
+}
+
+func (s *lsmShardStore) get(seriesID uint32, timestamp int64) ([]byte, error) {
+	if bucket, ok := s.mem[seriesID]; ok {
+		if rec, ok := bucket[timestamp]; ok {
+			if rec.tombstone {
+				return nil, nil
+			}
+			return s.materialize(rec)
+		}
+	}
+
+	// Search newest-to-oldest segment so later writes shadow earlier ones.
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		if bucket, ok := s.segments[i][seriesID]; ok {
+			if rec, ok := bucket[timestamp]; ok {
+				if rec.tombstone {
+					return nil, nil
+				}
+				return s.materialize(rec)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// putAll appends and applies every op in points for seriesID, resolving
+// seriesID's memtable bucket once rather than once per op.
+func (s *lsmShardStore) putAll(seriesID uint32, points []ShardWriteOp) error {
+	bucket, ok := s.mem[seriesID]
+	if !ok {
+		bucket = make(map[int64]*lsmRecord)
+		s.mem[seriesID] = bucket
+	}
+
+	for _, p := range points {
+		rec := &lsmRecord{seriesID: seriesID, timestamp: p.Timestamp, data: p.Data, tombstone: p.Tombstone}
+		if err := s.route(rec); err != nil {
+			return err
+		}
+		if err := appendLSMLogEntry(s.log, rec, lsmLogEntryPoint, ""); err != nil {
+			return err
+		}
+		bucket[rec.timestamp] = rec
+		s.memSize += rec.size()
+	}
+	return nil
+}
+
+// deleteSeries drops every point stored for seriesID. It logs a single
+// lsmLogEntryDeleteSeries entry rather than a per-point tombstone: a point
+// tombstone only covers the one timestamp it names, so replay would
+// resurrect every other timestamp the series was ever written at.
+func (s *lsmShardStore) deleteSeries(seriesID uint32) error {
+	tomb := &lsmRecord{seriesID: seriesID}
+	if err := appendLSMLogEntry(s.log, tomb, lsmLogEntryDeleteSeries, ""); err != nil {
+		return err
+	}
+
+	delete(s.mem, seriesID)
+	for _, seg := range s.segments {
+		delete(seg, seriesID)
+	}
+	return nil
+}
+
+func (s *lsmShardStore) metaGet(key string) []byte {
+	return s.meta[key]
+}
+
+func (s *lsmShardStore) metaPut(key string, value []byte) error {
+	if err := appendLSMLogEntry(s.log, &lsmRecord{data: value}, lsmLogEntryMeta, key); err != nil {
+		return err
+	}
+	s.meta[key] = value
+	return nil
+}
+
+// SeriesIDs returns the set of series currently stored, implementing
+// ShardStoreStats.
+func (s *lsmShardStore) SeriesIDs() ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[uint32]struct{})
+	for id := range s.mem {
+		seen[id] = struct{}{}
+	}
+	for _, seg := range s.segments {
+		for id := range seg {
+			seen[id] = struct{}{}
+		}
+	}
+
+	ids := make([]uint32, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// SeriesSize returns the approximate number of bytes stored for seriesID,
+// implementing ShardStoreStats.
+func (s *lsmShardStore) SeriesSize(seriesID uint32) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var size int64
+	if bucket, ok := s.mem[seriesID]; ok {
+		for _, rec := range bucket {
+			size += rec.size()
+		}
+	}
+	for _, seg := range s.segments {
+		if bucket, ok := seg[seriesID]; ok {
+			for _, rec := range bucket {
+				size += rec.size()
+			}
+		}
+	}
+	return size, nil
+}
+
+// SeriesPoints returns every stored, raw point for seriesID keyed by
+// timestamp, implementing ShardStoreStats. Tombstoned points are omitted.
+func (s *lsmShardStore) SeriesPoints(seriesID uint32) (map[int64][]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	points := make(map[int64][]byte)
+	for _, seg := range s.segments {
+		for ts, rec := range seg[seriesID] {
+			if rec.tombstone {
+				delete(points, ts)
+				continue
+			}
+			data, err := s.materialize(rec)
+			if err != nil {
+				return nil, err
+			}
+			points[ts] = data
+		}
+	}
+	for ts, rec := range s.mem[seriesID] {
+		if rec.tombstone {
+			delete(points, ts)
+			continue
+		}
+		data, err := s.materialize(rec)
+		if err != nil {
+			return nil, err
+		}
+		points[ts] = data
+	}
+	return points, nil
+}
+
+// RewriteSeries merges seriesID's entries across every segment and the
+// active memtable into a single, deduplicated bucket in the memtable,
+// implementing ShardStoreStats. This collapses the read-amplification a
+// series builds up as its records spread across flushed segments.
+func (s *lsmShardStore) RewriteSeries(seriesID uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	merged := make(map[int64]*lsmRecord)
+	for _, seg := range s.segments {
+		for ts, rec := range seg[seriesID] {
+			merged[ts] = rec
+		}
+		delete(seg, seriesID)
+	}
+	for ts, rec := range s.mem[seriesID] {
+		merged[ts] = rec
+	}
+
+	s.mem[seriesID] = merged
+	return nil
+}
+
+// lsmShardTx adapts an lsmShardStore to the ShardTx interface. A writable
+// tx (one created by Update) stages every write in memory instead of
+// applying it to the log/memtable immediately: Update only calls commit
+// once its callback has returned successfully, so a callback that returns
+// an error leaves the store exactly as it found it, matching the rollback
+// boltShardTx gets for free from BoltDB. Reads still see a tx's own
+// buffered writes by checking the staged state before falling back to the
+// store. A View tx (writable == false) rejects every write method with
+// ErrShardTxNotWritable instead of staging or applying anything, matching
+// BoltDB rejecting writes against a read-only *bolt.Tx.
+type lsmShardTx struct {
+	store    *lsmShardStore
+	writable bool
+
+	pending      map[uint32]map[int64]*lsmRecord
+	maskedSeries map[uint32]struct{} // series DeleteSeries was called on
+	pendingMeta  map[string][]byte
+}
+
+func (t *lsmShardTx) stage(rec *lsmRecord) {
+	if t.pending == nil {
+		t.pending = make(map[uint32]map[int64]*lsmRecord)
+	}
+	bucket, ok := t.pending[rec.seriesID]
+	if !ok {
+		bucket = make(map[int64]*lsmRecord)
+		t.pending[rec.seriesID] = bucket
+	}
+	bucket[rec.timestamp] = rec
+}
+
+func (t *lsmShardTx) PutSeriesPoint(seriesID uint32, timestamp int64, data []byte) error {
+	if !t.writable {
+		return ErrShardTxNotWritable
+	}
+	t.stage(&lsmRecord{seriesID: seriesID, timestamp: timestamp, data: data})
+	return nil
+}
+
+func (t *lsmShardTx) PutSeriesPoints(seriesID uint32, points []ShardWriteOp) error {
+	if !t.writable {
+		return ErrShardTxNotWritable
+	}
+	for _, p := range points {
+		t.stage(&lsmRecord{seriesID: seriesID, timestamp: p.Timestamp, data: p.Data, tombstone: p.Tombstone})
+	}
+	return nil
+}
+
+func (t *lsmShardTx) GetSeriesPoint(seriesID uint32, timestamp int64) ([]byte, error) {
+	if t.writable {
+		if bucket, ok := t.pending[seriesID]; ok {
+			if rec, ok := bucket[timestamp]; ok {
+				if rec.tombstone {
+					return nil, nil
+				}
+				return rec.data, nil
+			}
+		}
+		if _, masked := t.maskedSeries[seriesID]; masked {
+			return nil, nil
+		}
+	}
+	return t.store.get(seriesID, timestamp)
+}
+
+func (t *lsmShardTx) DeleteSeries(seriesID uint32) error {
+	if !t.writable {
+		return ErrShardTxNotWritable
+	}
+	if t.maskedSeries == nil {
+		t.maskedSeries = make(map[uint32]struct{})
+	}
+	t.maskedSeries[seriesID] = struct{}{}
+	delete(t.pending, seriesID)
+	return nil
+}
+
+func (t *lsmShardTx) DeleteSeriesPoint(seriesID uint32, timestamp int64) error {
+	if !t.writable {
+		return ErrShardTxNotWritable
+	}
+	t.stage(&lsmRecord{seriesID: seriesID, timestamp: timestamp, tombstone: true})
+	return nil
+}
+
+func (t *lsmShardTx) MetaGet(key string) ([]byte, error) {
+	if t.writable {
+		if v, ok := t.pendingMeta[key]; ok {
+			return v, nil
+		}
+	}
+	return t.store.metaGet(key), nil
+}
+
+func (t *lsmShardTx) MetaPut(key string, value []byte) error {
+	if !t.writable {
+		return ErrShardTxNotWritable
+	}
+	if t.pendingMeta == nil {
+		t.pendingMeta = make(map[string][]byte)
+	}
+	t.pendingMeta[key] = value
+	return nil
+}
+
+// commit applies every write staged during the transaction to the log and
+// memtable, in an order that preserves "a DeleteSeries followed by a put
+// for the same series, within the same tx, leaves the put visible": masked
+// series are dropped from the store first, then every staged point
+// (including ones for a masked series staged after its DeleteSeries) is
+// written. Only Update calls this, and only once its callback has
+// returned successfully.
+func (t *lsmShardTx) commit() error {
+	for seriesID := range t.maskedSeries {
+		if err := t.store.deleteSeries(seriesID); err != nil {
+			return err
+		}
+	}
+	for seriesID, bucket := range t.pending {
+		ops := make([]ShardWriteOp, 0, len(bucket))
+		for ts, rec := range bucket {
+			ops = append(ops, ShardWriteOp{Timestamp: ts, Data: rec.data, Tombstone: rec.tombstone})
+		}
+		if err := t.store.putAll(seriesID, ops); err != nil {
+			return err
+		}
+	}
+	for key, value := range t.pendingMeta {
+		if err := t.store.metaPut(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- commit log encoding ---
+//
+// Each entry is: kind(1) keyLen(2) key seriesID(4) timestamp(8) entryFlags(1)
+// then either offset(8) length(8) (when entryFlags has lsmEntryFlagValueRef
+// set) or dataLen(4) data. Encoding a record's valueRef directly, instead
+// of always re-embedding its full payload, means replay can reconstruct an
+// out-of-line record's placement from the log entry alone without writing
+// the payload to the value log a second time.
+const (
+	lsmEntryFlagTombstone uint8 = 1 << 0
+	lsmEntryFlagValueRef  uint8 = 1 << 1
+)
+
+func appendLSMLogEntry(w io.Writer, rec *lsmRecord, kind lsmLogEntryKind, metaKey string) error {
+	bw := bufio.NewWriter(w)
+
+	if err := bw.WriteByte(byte(kind)); err != nil {
+		return err
+	}
+
+	keyBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(keyBuf, uint16(len(metaKey)))
+	if _, err := bw.Write(keyBuf); err != nil {
+		return err
+	}
+	if _, err := bw.WriteString(metaKey); err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4+8+1)
+	binary.BigEndian.PutUint32(hdr[0:4], rec.seriesID)
+	binary.BigEndian.PutUint64(hdr[4:12], uint64(rec.timestamp))
+	var entryFlags uint8
+	if rec.tombstone {
+		entryFlags |= lsmEntryFlagTombstone
+	}
+	if rec.valueRef != nil {
+		entryFlags |= lsmEntryFlagValueRef
+	}
+	hdr[12] = entryFlags
+	if _, err := bw.Write(hdr); err != nil {
+		return err
+	}
+
+	if rec.valueRef != nil {
+		refBuf := make([]byte, 16)
+		binary.BigEndian.PutUint64(refBuf[0:8], uint64(rec.valueRef.offset))
+		binary.BigEndian.PutUint64(refBuf[8:16], uint64(rec.valueRef.length))
+		if _, err := bw.Write(refBuf); err != nil {
+			return err
+		}
+	} else {
+		dataLenBuf := make([]byte, 4)
+		binary.BigEndian.PutUint32(dataLenBuf, uint32(len(rec.data)))
+		if _, err := bw.Write(dataLenBuf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(rec.data); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+func readLSMLogEntry(r *bufio.Reader) (rec *lsmRecord, kind lsmLogEntryKind, metaKey string, err error) {
+	kindByte, err := r.ReadByte()
+	if err != nil {
+		return nil, 0, "", err
+	}
+	kind = lsmLogEntryKind(kindByte)
+
+	keyBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, keyBuf); err != nil {
+		return nil, 0, "", err
+	}
+	keyLen := binary.BigEndian.Uint16(keyBuf)
+
+	keyBytes := make([]byte, keyLen)
+	if keyLen > 0 {
+		if _, err := io.ReadFull(r, keyBytes); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	hdr := make([]byte, 4+8+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, 0, "", err
+	}
+
+	entryFlags := hdr[12]
+	rec = &lsmRecord{
+		seriesID:  binary.BigEndian.Uint32(hdr[0:4]),
+		timestamp: int64(binary.BigEndian.Uint64(hdr[4:12])),
+		tombstone: entryFlags&lsmEntryFlagTombstone != 0,
+	}
+
+	if entryFlags&lsmEntryFlagValueRef != 0 {
+		refBuf := make([]byte, 16)
+		if _, err := io.ReadFull(r, refBuf); err != nil {
+			return nil, 0, "", err
+		}
+		rec.valueRef = &lsmValueRef{
+			offset: int64(binary.BigEndian.Uint64(refBuf[0:8])),
+			length: int64(binary.BigEndian.Uint64(refBuf[8:16])),
+		}
+		return rec, kind, string(keyBytes), nil
+	}
+
+	dataLenBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, dataLenBuf); err != nil {
+		return nil, 0, "", err
+	}
+	dataLen := binary.BigEndian.Uint32(dataLenBuf)
+	if dataLen > 0 {
+		rec.data = make([]byte, dataLen)
+		if _, err := io.ReadFull(r, rec.data); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	return rec, kind, string(keyBytes), nil
+}
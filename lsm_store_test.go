@@ -0,0 +1,293 @@
+package influxdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLSMShardStore_DeleteSeries_SurvivesRestart verifies that deleting a
+// series removes every point it had, not just the one at timestamp 0, and
+// that the deletion survives a close/reopen instead of the commit log
+// replaying the series' earlier puts back into existence.
+func TestLSMShardStore_DeleteSeries_SurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard.lsm")
+	const seriesID = uint32(7)
+
+	store := newLSMShardStore(NewLSMOptions())
+	if err := store.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Update(func(tx ShardTx) error {
+		for ts := int64(1); ts <= 5; ts++ {
+			if err := tx.PutSeriesPoint(seriesID, ts, []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Update(func(tx ShardTx) error {
+		return tx.DeleteSeries(seriesID)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deletion must also be visible before any restart.
+	points, err := store.SeriesPoints(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Fatalf("expected no points for deleted series before restart, got %v", points)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newLSMShardStore(NewLSMOptions())
+	if err := reopened.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	points, err = reopened.SeriesPoints(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Fatalf("expected no points for deleted series after restart, got %v", points)
+	}
+}
+
+// TestLSMShardStore_Update_RollsBackOnError verifies that when the
+// callback passed to Update returns an error partway through a batch,
+// nothing it already wrote stays applied — matching boltShardTx, which
+// gets this for free from BoltDB rolling back the whole transaction.
+func TestLSMShardStore_Update_RollsBackOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard.lsm")
+	const seriesID = uint32(9)
+
+	store := newLSMShardStore(NewLSMOptions())
+	if err := store.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	wantErr := errors.New("boom")
+	err := store.Update(func(tx ShardTx) error {
+		if err := tx.PutSeriesPoint(seriesID, 1, []byte("v")); err != nil {
+			return err
+		}
+		if err := tx.MetaPut("partial", []byte("v")); err != nil {
+			return err
+		}
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("got err %v, want %v", err, wantErr)
+	}
+
+	points, err := store.SeriesPoints(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Fatalf("expected no points after a rolled-back Update, got %v", points)
+	}
+
+	if err := store.View(func(tx ShardTx) error {
+		v, err := tx.MetaGet("partial")
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			t.Fatalf("expected meta key not to be persisted after a rolled-back Update, got %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLSMShardStore_ValueThreshold_RoutesLargePayloadsOutOfLine verifies
+// ValueThreshold actually changes storage behavior: a payload at or above
+// the threshold is stored by reference in a separate value log rather than
+// inline in the memtable, and reads still return the exact original bytes,
+// both before and after a restart.
+func TestLSMShardStore_ValueThreshold_RoutesLargePayloadsOutOfLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard.lsm")
+	const smallSeriesID = uint32(1)
+	const bigSeriesID = uint32(2)
+
+	opt := LSMOptions{MemTableSize: DefaultLSMMemTableSize, ValueThreshold: 16}
+	store := newLSMShardStore(opt)
+	if err := store.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	small := []byte("tiny")
+	big := make([]byte, 256)
+	for i := range big {
+		big[i] = byte(i)
+	}
+
+	if err := store.Update(func(tx ShardTx) error {
+		if err := tx.PutSeriesPoint(smallSeriesID, 1, small); err != nil {
+			return err
+		}
+		return tx.PutSeriesPoint(bigSeriesID, 1, big)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	bigRec := store.mem[bigSeriesID][1]
+	if bigRec.valueRef == nil {
+		t.Fatal("expected payload at or above ValueThreshold to be routed to the value log")
+	}
+	smallRec := store.mem[smallSeriesID][1]
+	if smallRec.valueRef != nil {
+		t.Fatal("expected payload below ValueThreshold to stay inline")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := newLSMShardStore(opt)
+	if err := reopened.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.get(bigSeriesID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(big) {
+		t.Fatalf("big payload not round-tripped through value log: got %d bytes, want %d", len(got), len(big))
+	}
+
+	got, err = reopened.get(smallSeriesID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(small) {
+		t.Fatalf("small payload mismatch: got %q, want %q", got, small)
+	}
+}
+
+// TestLSMShardStore_ValueLog_DoesNotGrowAcrossRestarts verifies that
+// reopening a store with an out-of-line payload doesn't re-route (and
+// thus re-append) it to the value log: replay must reinstate a record's
+// existing placement rather than routing it again, or the value log
+// would grow by one more copy of every out-of-line payload on every
+// restart.
+func TestLSMShardStore_ValueLog_DoesNotGrowAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard.lsm")
+	const seriesID = uint32(1)
+
+	opt := LSMOptions{MemTableSize: DefaultLSMMemTableSize, ValueThreshold: 16}
+	payload := make([]byte, 2000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	store := newLSMShardStore(opt)
+	if err := store.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(func(tx ShardTx) error {
+		return tx.PutSeriesPoint(seriesID, 1, payload)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vlogPath := path + lsmValueLogSuffix
+	info, err := os.Stat(vlogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSize := info.Size()
+	if wantSize < int64(len(payload)) {
+		t.Fatalf("value log is %d bytes, expected at least %d", wantSize, len(payload))
+	}
+
+	for i := 0; i < 3; i++ {
+		reopened := newLSMShardStore(opt)
+		if err := reopened.Open(path); err != nil {
+			t.Fatalf("reopen %d: %s", i, err)
+		}
+
+		got, err := reopened.get(seriesID, 1)
+		if err != nil {
+			t.Fatalf("reopen %d: get: %s", i, err)
+		}
+		if string(got) != string(payload) {
+			t.Fatalf("reopen %d: payload mismatch: got %d bytes, want %d", i, len(got), len(payload))
+		}
+
+		if err := reopened.Close(); err != nil {
+			t.Fatalf("reopen %d: close: %s", i, err)
+		}
+
+		info, err := os.Stat(vlogPath)
+		if err != nil {
+			t.Fatalf("reopen %d: stat: %s", i, err)
+		}
+		if info.Size() != wantSize {
+			t.Fatalf("reopen %d: value log is %d bytes, want %d (unchanged)", i, info.Size(), wantSize)
+		}
+	}
+}
+
+// TestLSMShardStore_View_RejectsWrites verifies every write method on a
+// View tx returns ErrShardTxNotWritable instead of mutating the store,
+// matching BoltDB rejecting writes against a read-only *bolt.Tx.
+func TestLSMShardStore_View_RejectsWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shard.lsm")
+	const seriesID = uint32(3)
+
+	store := newLSMShardStore(NewLSMOptions())
+	if err := store.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if err := store.View(func(tx ShardTx) error {
+		if err := tx.PutSeriesPoint(seriesID, 1, []byte("v")); err != ErrShardTxNotWritable {
+			t.Errorf("PutSeriesPoint: got %v, want ErrShardTxNotWritable", err)
+		}
+		if err := tx.PutSeriesPoints(seriesID, []ShardWriteOp{{Timestamp: 1, Data: []byte("v")}}); err != ErrShardTxNotWritable {
+			t.Errorf("PutSeriesPoints: got %v, want ErrShardTxNotWritable", err)
+		}
+		if err := tx.DeleteSeriesPoint(seriesID, 1); err != ErrShardTxNotWritable {
+			t.Errorf("DeleteSeriesPoint: got %v, want ErrShardTxNotWritable", err)
+		}
+		if err := tx.DeleteSeries(seriesID); err != ErrShardTxNotWritable {
+			t.Errorf("DeleteSeries: got %v, want ErrShardTxNotWritable", err)
+		}
+		if err := tx.MetaPut("key", []byte("v")); err != ErrShardTxNotWritable {
+			t.Errorf("MetaPut: got %v, want ErrShardTxNotWritable", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := store.SeriesPoints(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 0 {
+		t.Fatalf("expected no points stored after rejected View writes, got %v", points)
+	}
+}
@@ -0,0 +1,171 @@
+package influxdb
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Point precision flags occupy bits 0-1 of a point's flag byte and record
+// the unit the point's timestamp was written in.
+const (
+	PointPrecisionNanosecond uint8 = iota
+	PointPrecisionMicrosecond
+	PointPrecisionMillisecond
+	PointPrecisionSecond
+)
+
+// Point compression flags occupy bits 2-3 of a point's flag byte and
+// record the scheme used to compress the point's payload.
+const (
+	PointCompressionNone uint8 = iota
+	PointCompressionSnappy
+	PointCompressionZstd
+)
+
+// pointFlagTombstone is bit 4 of a point's flag byte. It marks a point as a
+// delete of whatever was previously stored for its seriesID and timestamp,
+// so single-point deletes don't need a distinct wire message type.
+const pointFlagTombstone uint8 = 1 << 4
+
+const (
+	pointFlagPrecisionMask   = 0x3
+	pointFlagCompressionMask = 0x3
+	pointFlagCompressionBit  = 2
+)
+
+// makePointFlags packs precision, compression and the tombstone bit into a
+// single flag byte.
+func makePointFlags(precision, compression uint8, tombstone bool) uint8 {
+	f := (precision & pointFlagPrecisionMask) | ((compression & pointFlagCompressionMask) << pointFlagCompressionBit)
+	if tombstone {
+		f |= pointFlagTombstone
+	}
+	return f
+}
+
+func pointFlagPrecision(flags uint8) uint8 { return flags & pointFlagPrecisionMask }
+
+func pointFlagCompression(flags uint8) uint8 {
+	return (flags >> pointFlagCompressionBit) & pointFlagCompressionMask
+}
+
+func pointFlagIsTombstone(flags uint8) bool { return flags&pointFlagTombstone != 0 }
+
+// pointPayloadLengthMask and pointFlagsShift split the 4-byte field that
+// used to hold only payloadLength: the low 24 bits remain payloadLength,
+// the high 8 bits hold the point's flag byte. 24 bits comfortably covers
+// any single point payload this module writes.
+const (
+	pointPayloadLengthMask = 0x00FFFFFF
+	pointFlagsShift        = 24
+)
+
+// marshalPointHeader encodes a series id, payload length, timestamp and
+// flagset into a byte slice. It returns ErrInvalidPointBuffer if
+// payloadLength doesn't fit in the 24 bits available to it.
+func marshalPointHeader(seriesID uint32, payloadLength uint32, timestamp int64, flags uint8) ([]byte, error) {
+	if payloadLength > pointPayloadLengthMask {
+		return nil, ErrInvalidPointBuffer
+	}
+
+	b := make([]byte, pointHeaderSize)
+	binary.BigEndian.PutUint32(b[0:4], seriesID)
+	binary.BigEndian.PutUint32(b[4:8], payloadLength|(uint32(flags)<<pointFlagsShift))
+	binary.BigEndian.PutUint64(b[8:16], uint64(timestamp))
+	return b, nil
+}
+
+// unmarshalPointHeader decodes a byte slice into a series id, payload
+// length, timestamp & flagset.
+func unmarshalPointHeader(b []byte) (seriesID uint32, payloadLength uint32, timestamp int64, flags uint8) {
+	seriesID = binary.BigEndian.Uint32(b[0:4])
+
+	raw := binary.BigEndian.Uint32(b[4:8])
+	payloadLength = raw & pointPayloadLengthMask
+	flags = uint8(raw >> pointFlagsShift)
+
+	timestamp = int64(binary.BigEndian.Uint64(b[8:16]))
+	return
+}
+
+// compressPayload compresses data per scheme before it's handed to the
+// store.
+func compressPayload(scheme uint8, data []byte) ([]byte, error) {
+	switch scheme {
+	case PointCompressionNone:
+		return data, nil
+	case PointCompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	case PointCompressionZstd:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown point compression scheme: %d", scheme)
+	}
+}
+
+// Shard on-disk format versions, stored under shardFormatVersionKey in the
+// meta bucket so open() can detect and migrate shards written by an older
+// build.
+const (
+	// shardFormatVersionLegacy is the original layout: a series' stored
+	// value is its raw, uncompressed payload with no flag byte. A shard
+	// with no stored format version is assumed to be this version.
+	shardFormatVersionLegacy = 1
+
+	// currentShardFormatVersion prefixes each stored value with a flag
+	// byte, allowing per-point compression and inline tombstones.
+	currentShardFormatVersion = 2
+)
+
+// shardFormatVersionKey is the meta key holding a shard's on-disk format
+// version.
+const shardFormatVersionKey = "format_version"
+
+// encodeStoredPoint compresses data per flags' compression scheme and
+// prefixes it with flags, producing the value written to a ShardStore
+// under currentShardFormatVersion.
+func encodeStoredPoint(flags uint8, data []byte) ([]byte, error) {
+	compressed, err := compressPayload(pointFlagCompression(flags), data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{flags}, compressed...), nil
+}
+
+// decodeStoredPoint reverses encodeStoredPoint. Values read from a shard
+// still at shardFormatVersionLegacy have no flag byte and are returned
+// as-is.
+func decodeStoredPoint(formatVersion int, stored []byte) ([]byte, error) {
+	if formatVersion < currentShardFormatVersion || len(stored) == 0 {
+		return stored, nil
+	}
+	flags, payload := stored[0], stored[1:]
+	return decompressPayload(pointFlagCompression(flags), payload)
+}
+
+// decompressPayload reverses compressPayload.
+func decompressPayload(scheme uint8, data []byte) ([]byte, error) {
+	switch scheme {
+	case PointCompressionNone:
+		return data, nil
+	case PointCompressionSnappy:
+		return snappy.Decode(nil, data)
+	case PointCompressionZstd:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown point compression scheme: %d", scheme)
+	}
+}
@@ -0,0 +1,159 @@
+package influxdb
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultEnforcementInterval is how often Enforce checks retention and
+// compaction policies when a ShardGroup doesn't set its own interval.
+const DefaultEnforcementInterval = 10 * time.Minute
+
+// DefaultMaxSeriesBucketSize is the per-series size, in bytes, above which
+// a series is rewritten into a denser encoding.
+const DefaultMaxSeriesBucketSize = 64 << 20 // 64MB
+
+// DefaultCompactionPolicy is used by a shard group that doesn't set its own.
+var DefaultCompactionPolicy = CompactionPolicy{MaxSeriesBucketSize: DefaultMaxSeriesBucketSize}
+
+// RetentionPolicy describes how long data written to a shard group should
+// be kept, and how many copies of it should exist across the cluster.
+type RetentionPolicy struct {
+	// Duration is how long a shard group's data is retained, measured from
+	// the group's EndTime. A zero Duration disables retention enforcement.
+	Duration time.Duration
+
+	// Replication is the number of data nodes each shard in the group
+	// should be replicated to.
+	Replication int
+}
+
+// CompactionPolicy controls when a series' stored data is rewritten into a
+// denser on-disk encoding.
+type CompactionPolicy struct {
+	// MaxSeriesBucketSize is the size, in bytes, a single series' stored
+	// data may reach before it is rewritten. Zero disables compaction
+	// enforcement.
+	MaxSeriesBucketSize int64
+}
+
+// Clock abstracts wall-clock access so enforcement loops can be driven
+// deterministically in tests instead of waiting on real time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Tick returns a Ticker that receives the current time every d,
+	// analogous to time.NewTicker. The caller must Stop it once done.
+	Tick(d time.Duration) Ticker
+}
+
+// Ticker is a stoppable source of time ticks. It exists so Clock.Tick can
+// hand back something a caller can release, unlike time.Tick, which leaks
+// its underlying timer for the life of the process.
+type Ticker interface {
+	// C returns the channel on which ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop releases the ticker's resources. Safe to call once the caller
+	// is done reading from C.
+	Stop()
+}
+
+// wallClock is the default Clock, backed by the standard library.
+type wallClock struct{}
+
+// NewClock returns the default, real-time Clock implementation.
+func NewClock() Clock { return wallClock{} }
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) Tick(d time.Duration) Ticker { return wallTicker{time.NewTicker(d)} }
+
+// wallTicker adapts a *time.Ticker to the Ticker interface.
+type wallTicker struct{ t *time.Ticker }
+
+func (w wallTicker) C() <-chan time.Time { return w.t.C }
+func (w wallTicker) Stop()               { w.t.Stop() }
+
+// Enforce runs the shard group's retention and compaction policies on
+// EnforcementInterval (or DefaultEnforcementInterval) until ctx is done or
+// the group expires under its RetentionPolicy. When the group expires it is
+// closed and OnExpire, if set, is called with the group before Enforce
+// returns.
+func (g *ShardGroup) Enforce(ctx context.Context) error {
+	clock := g.Clock
+	if clock == nil {
+		clock = NewClock()
+	}
+
+	interval := g.EnforcementInterval
+	if interval <= 0 {
+		interval = DefaultEnforcementInterval
+	}
+
+	ticker := clock.Tick(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C():
+			if g.enforceOnce(now) {
+				return nil
+			}
+		}
+	}
+}
+
+// enforceOnce applies the group's retention and compaction policies as of
+// now, and reports whether the group expired and was closed.
+func (g *ShardGroup) enforceOnce(now time.Time) (expired bool) {
+	if g.RetentionPolicy.Duration > 0 && now.Sub(g.EndTime) > g.RetentionPolicy.Duration {
+		g.close()
+		if g.OnExpire != nil {
+			g.OnExpire(g)
+		}
+		return true
+	}
+
+	policy := g.CompactionPolicy
+	if policy.MaxSeriesBucketSize <= 0 {
+		return false
+	}
+	for _, sh := range g.Shards {
+		if err := sh.compact(policy); err != nil && g.OnCompactError != nil {
+			g.OnCompactError(sh, err)
+		}
+	}
+	return false
+}
+
+// compact rewrites any series whose stored size exceeds policy's threshold
+// into a denser encoding. Stores that don't implement ShardStoreStats are
+// left untouched.
+func (s *Shard) compact(policy CompactionPolicy) error {
+	stats, ok := s.store.(ShardStoreStats)
+	if !ok {
+		return nil
+	}
+
+	ids, err := stats.SeriesIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		size, err := stats.SeriesSize(id)
+		if err != nil {
+			return err
+		}
+		if size > policy.MaxSeriesBucketSize {
+			if err := stats.RewriteSeries(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
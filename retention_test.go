@@ -0,0 +1,106 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// statsErrorStore is a ShardStoreStats whose SeriesSize always fails, used
+// to verify that Enforce's compaction pass surfaces a shard's error
+// instead of swallowing it.
+type statsErrorStore struct{ err error }
+
+func (s *statsErrorStore) Open(string) error                      { return nil }
+func (s *statsErrorStore) Close() error                           { return nil }
+func (s *statsErrorStore) Update(fn func(tx ShardTx) error) error { return fn(nil) }
+func (s *statsErrorStore) View(fn func(tx ShardTx) error) error   { return fn(nil) }
+func (s *statsErrorStore) Snapshot(w io.Writer) error             { return nil }
+func (s *statsErrorStore) Restore(r io.Reader) error              { return nil }
+
+func (s *statsErrorStore) SeriesIDs() ([]uint32, error)     { return []uint32{1}, nil }
+func (s *statsErrorStore) SeriesSize(uint32) (int64, error) { return 0, s.err }
+func (s *statsErrorStore) RewriteSeries(uint32) error       { return nil }
+func (s *statsErrorStore) SeriesPoints(uint32) (map[int64][]byte, error) {
+	return nil, nil
+}
+
+// TestShardGroup_Enforce_DropsExpiredGroup verifies that a shard group is
+// closed and reported via OnExpire only once the mock clock has advanced
+// past its retention duration, and not before.
+func TestShardGroup_Enforce_DropsExpiredGroup(t *testing.T) {
+	clock := newMockClock(time.Unix(0, 0))
+
+	g := newShardGroup()
+	g.EndTime = clock.Now()
+	g.Clock = clock
+	g.RetentionPolicy = RetentionPolicy{Duration: time.Hour}
+	g.EnforcementInterval = time.Millisecond // irrelevant; Tick is mocked
+
+	expired := make(chan *ShardGroup, 1)
+	g.OnExpire = func(sg *ShardGroup) { expired <- sg }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- g.Enforce(ctx) }()
+
+	// Not yet past retention: the group must survive this tick.
+	clock.Advance(30 * time.Minute)
+	select {
+	case <-expired:
+		t.Fatal("shard group expired before its retention duration elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Past retention: the group must be closed and reported.
+	clock.Advance(45 * time.Minute)
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for shard group to expire")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Enforce did not return after the group expired")
+	}
+}
+
+// TestShardGroup_Enforce_ReportsCompactError verifies that a shard's
+// compact error during Enforce's compaction pass reaches OnCompactError
+// instead of being silently dropped.
+func TestShardGroup_Enforce_ReportsCompactError(t *testing.T) {
+	clock := newMockClock(time.Unix(0, 0))
+	wantErr := errors.New("stats unavailable")
+
+	sh := newShard()
+	sh.store = &statsErrorStore{err: wantErr}
+
+	g := newShardGroup()
+	g.Shards = []*Shard{sh}
+	g.Clock = clock
+	g.EnforcementInterval = time.Millisecond // irrelevant; Tick is mocked
+
+	reported := make(chan error, 1)
+	g.OnCompactError = func(s *Shard, err error) { reported <- err }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go g.Enforce(ctx)
+
+	clock.Advance(time.Minute)
+	select {
+	case err := <-reported:
+		if err != wantErr {
+			t.Fatalf("got err %v, want %v", err, wantErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for OnCompactError")
+	}
+}
@@ -1,12 +1,10 @@
 package influxdb
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
-
-	"github.com/boltdb/bolt"
 )
 
 // ShardGroup represents a group of shards created for a single time range.
@@ -15,10 +13,35 @@ type ShardGroup struct {
 	StartTime time.Time `json:"startTime,omitempty"`
 	EndTime   time.Time `json:"endTime,omitempty"`
 	Shards    []*Shard  `json:"shards,omitempty"`
+
+	// RetentionPolicy and CompactionPolicy govern what Enforce does on
+	// each tick of EnforcementInterval (DefaultEnforcementInterval if unset).
+	RetentionPolicy     RetentionPolicy  `json:"retentionPolicy,omitempty"`
+	CompactionPolicy    CompactionPolicy `json:"compactionPolicy,omitempty"`
+	EnforcementInterval time.Duration    `json:"enforcementInterval,omitempty"`
+
+	// Clock is injected so Enforce can be driven deterministically in
+	// tests; it defaults to the real wall clock.
+	Clock Clock `json:"-"`
+
+	// OnExpire, if set, is called with the group when Enforce closes it
+	// for having aged out under RetentionPolicy.
+	OnExpire func(*ShardGroup) `json:"-"`
+
+	// OnCompactError, if set, is called with the shard and error whenever
+	// Enforce's compaction pass fails for one of the group's shards. A
+	// failure for one shard doesn't stop Enforce from compacting the
+	// rest of the group.
+	OnCompactError func(*Shard, error) `json:"-"`
 }
 
 // newShardGroup returns a new initialized ShardGroup instance.
-func newShardGroup() *ShardGroup { return &ShardGroup{} }
+func newShardGroup() *ShardGroup {
+	return &ShardGroup{
+		CompactionPolicy: DefaultCompactionPolicy,
+		Clock:            NewClock(),
+	}
+}
 
 // close closes all shards.
 func (g *ShardGroup) close() {
@@ -60,13 +83,49 @@ type Shard struct {
 	ID          uint64   `json:"id,omitempty"`
 	DataNodeIDs []uint64 `json:"nodeIDs,omitempty"` // owners
 
-	index uint64        // highest replicated index
-	store *bolt.DB      // underlying data store
-	conn  MessagingConn // streaming connection to broker
+	// StoreConfig selects the storage engine used by open and its
+	// tunables. It is set on the shard itself; ShardGroup has no engine
+	// setting that its shards inherit.
+	StoreConfig ShardStoreConfig `json:"-"`
+
+	// PipelineConfig tunes the asynchronous write queue open starts
+	// between conn.C() and the store. Like StoreConfig, it is set on the
+	// shard itself, not inherited from the owning ShardGroup.
+	PipelineConfig WritePipelineConfig `json:"-"`
+
+	index         uint64        // highest replicated index; once the write pipeline runs, access via loadIndex/setIndex
+	store         ShardStore    // underlying data store
+	conn          MessagingConn // streaming connection to broker
+	formatVersion int32         // on-disk point format, access via loadFormatVersion/setFormatVersion
+	pipeline      *writePipeline
+	readonly      int32 // set by ReadonlyWriteErrorPolicy; access via atomic
 }
 
 // newShard returns a new initialized Shard instance.
-func newShard() *Shard { return &Shard{} }
+func newShard() *Shard {
+	return &Shard{
+		StoreConfig:    NewShardStoreConfig(),
+		PipelineConfig: NewWritePipelineConfig(),
+	}
+}
+
+// loadIndex returns the shard's highest applied index. It's safe to call
+// concurrently with the write pipeline's workers advancing it.
+func (s *Shard) loadIndex() uint64 { return atomic.LoadUint64(&s.index) }
+
+// setIndex sets the shard's highest applied index. It's safe to call
+// concurrently with readers using loadIndex.
+func (s *Shard) setIndex(v uint64) { atomic.StoreUint64(&s.index, v) }
+
+// loadFormatVersion returns the shard's on-disk point format version. It's
+// safe to call concurrently with a Restore in progress: a replica applying
+// a snapshot while still serving reads is the normal case snapshot
+// catch-up exists for, not an edge case.
+func (s *Shard) loadFormatVersion() int { return int(atomic.LoadInt32(&s.formatVersion)) }
+
+// setFormatVersion sets the shard's on-disk point format version. It's
+// safe to call concurrently with readers using loadFormatVersion.
+func (s *Shard) setFormatVersion(v int) { atomic.StoreInt32(&s.formatVersion, int32(v)) }
 
 // open initializes and opens the shard's store.
 func (s *Shard) open(path string, conn MessagingConn) error {
@@ -75,36 +134,65 @@ func (s *Shard) open(path string, conn MessagingConn) error {
 		return errors.New("shard already open")
 	}
 
-	// Open store on shard.
-	store, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	// Dispatch to the configured storage engine.
+	store, err := newShardStore(s.StoreConfig)
 	if err != nil {
 		return err
 	}
+	if err := store.Open(path); err != nil {
+		return err
+	}
 	s.store = store
 
-	// Initialize store.
+	// Find highest replicated index and on-disk point format version.
 	s.index = 0
-	if err := s.store.Update(func(tx *bolt.Tx) error {
-		_, _ = tx.CreateBucketIfNotExists([]byte("values"))
-
-		// Find highest replicated index.
-		b, _ := tx.CreateBucketIfNotExists([]byte("meta"))
-		if buf := b.Get([]byte("index")); len(buf) > 0 {
+	s.setFormatVersion(shardFormatVersionLegacy)
+	if err := s.store.View(func(tx ShardTx) error {
+		buf, err := tx.MetaGet("index")
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
 			s.index = btou64(buf)
 		}
 
+		buf, err = tx.MetaGet(shardFormatVersionKey)
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			s.setFormatVersion(int(btou64(buf)))
+		}
 		return nil
 	}); err != nil {
 		_ = s.close()
 		return fmt.Errorf("init: %s", err)
 	}
 
+	// Migrate any points still in an older on-disk format before serving
+	// reads or accepting writes.
+	if s.loadFormatVersion() < currentShardFormatVersion {
+		if err := s.upgradeFormat(); err != nil {
+			_ = s.close()
+			return fmt.Errorf("upgrade shard format: %s", err)
+		}
+	}
+
+	// If we're far enough behind the broker's tail, ask a peer for a
+	// snapshot before falling back to a full replay from s.index.
+	s.requestSnapshotCatchup(conn)
+
 	// Open connection.
 	if err := conn.Open(s.index, true); err != nil {
 		_ = s.close()
 		return fmt.Errorf("open shard conn: id=%d, idx=%d, err=%s", s.ID, s.index, err)
 	}
 
+	// Start the write pipeline before processor so the first coalesced
+	// batch always has somewhere to go.
+	s.pipeline = newWritePipeline(s.PipelineConfig)
+	s.pipeline.start(s)
+
 	// Start importing from connection.
 	go s.processor(conn)
 
@@ -119,6 +207,73 @@ func (s *Shard) close() error {
 	return nil
 }
 
+// Store returns the shard's underlying storage engine.
+func (s *Shard) Store() ShardStore { return s.store }
+
+// Errors returns the channel the shard's write pipeline reports coalesced
+// commit failures on, including ones its OnWriteError policy recovered
+// from. It's buffered to DefaultErrorChannelDepth; errors are dropped, not
+// blocked on, once that buffer fills, so a caller should keep draining it.
+func (s *Shard) Errors() <-chan error { return s.pipeline.errCh }
+
+// Readonly reports whether the shard's write pipeline has stopped applying
+// writes after PipelineConfig.OnWriteError returned WriteErrorReadonly.
+func (s *Shard) Readonly() bool { return atomic.LoadInt32(&s.readonly) != 0 }
+
+// setReadonly marks the shard read-only so the pipeline drops further
+// commits instead of applying them.
+func (s *Shard) setReadonly(err error) { atomic.StoreInt32(&s.readonly, 1) }
+
+// upgradeFormat rewrites every stored point from shardFormatVersionLegacy
+// into currentShardFormatVersion, then records the new version so future
+// opens skip straight to it. Points written under the legacy format have
+// no flag byte, so they're treated as uncompressed, non-tombstoned data.
+func (s *Shard) upgradeFormat() error {
+	stats, ok := s.store.(ShardStoreStats)
+	if !ok {
+		// Nothing we can enumerate to migrate; just record the new
+		// version so writes from here on use the current layout.
+		s.setFormatVersion(currentShardFormatVersion)
+		return s.store.Update(func(tx ShardTx) error {
+			return tx.MetaPut(shardFormatVersionKey, u64tob(uint64(currentShardFormatVersion)))
+		})
+	}
+
+	ids, err := stats.SeriesIDs()
+	if err != nil {
+		return err
+	}
+
+	// Fetch every series' points up front rather than from inside
+	// Update's callback: SeriesPoints takes the same lock Update holds
+	// for the LSM engine, and that lock isn't reentrant.
+	pointsByID := make(map[uint32]map[int64][]byte, len(ids))
+	for _, id := range ids {
+		points, err := stats.SeriesPoints(id)
+		if err != nil {
+			return err
+		}
+		pointsByID[id] = points
+	}
+
+	return s.store.Update(func(tx ShardTx) error {
+		for id, points := range pointsByID {
+			for timestamp, raw := range points {
+				stored, err := encodeStoredPoint(0, raw)
+				if err != nil {
+					return err
+				}
+				if err := tx.PutSeriesPoint(id, timestamp, stored); err != nil {
+					return err
+				}
+			}
+		}
+
+		s.setFormatVersion(currentShardFormatVersion)
+		return tx.MetaPut(shardFormatVersionKey, u64tob(uint64(currentShardFormatVersion)))
+	})
+}
+
 // HasDataNodeID return true if the data node owns the shard.
 func (s *Shard) HasDataNodeID(id uint64) bool {
 	for _, dataNodeID := range s.DataNodeIDs {
@@ -131,55 +286,75 @@ func (s *Shard) HasDataNodeID(id uint64) bool {
 
 // readSeries reads encoded series data from a shard.
 func (s *Shard) readSeries(seriesID uint32, timestamp int64) (values []byte, err error) {
-	err = s.store.View(func(tx *bolt.Tx) error {
-		// Find series bucket.
-		b := tx.Bucket(u32tob(seriesID))
-		if b == nil {
-			return nil
+	err = s.store.View(func(tx ShardTx) error {
+		stored, err := tx.GetSeriesPoint(seriesID, timestamp)
+		if err != nil || stored == nil {
+			return err
 		}
-
-		// Retrieve encoded series data.
-		values = b.Get(u64tob(uint64(timestamp)))
-		return nil
+		values, err = decodeStoredPoint(s.loadFormatVersion(), stored)
+		return err
 	})
 	return
 }
 
-// writeSeries writes series batch to a shard.
+// writeSeries writes series batch to a shard. Points are grouped by
+// seriesID before being applied so a series with many points in the batch
+// only costs one bucket/segment lookup, not one per point.
 func (s *Shard) writeSeries(index uint64, batch []byte) error {
-	return s.store.Update(func(tx *bolt.Tx) error {
-		for {
-			if pointHeaderSize > len(batch) {
-				return ErrInvalidPointBuffer
-			}
-			seriesID, payloadLength, timestamp := unmarshalPointHeader(batch[:pointHeaderSize])
-			batch = batch[pointHeaderSize:]
+	order, grouped, err := groupBatchBySeries(batch)
+	if err != nil {
+		return err
+	}
+	return s.writeGroupedSeries(index, order, grouped)
+}
 
-			if payloadLength > uint32(len(batch)) {
-				return ErrInvalidPointBuffer
-			}
-			data := batch[:payloadLength]
+// groupBatchBySeries parses every point header in batch and groups the
+// resulting ops by seriesID, preserving the order series were first seen
+// so writeGroupedSeries' iteration order is deterministic.
+func groupBatchBySeries(batch []byte) (order []uint32, grouped map[uint32][]ShardWriteOp, err error) {
+	grouped = make(map[uint32][]ShardWriteOp)
+	for len(batch) > 0 {
+		if pointHeaderSize > len(batch) {
+			return nil, nil, ErrInvalidPointBuffer
+		}
+		seriesID, payloadLength, timestamp, flags := unmarshalPointHeader(batch[:pointHeaderSize])
+		batch = batch[pointHeaderSize:]
 
-			// Create a bucket for the series.
-			b, err := tx.CreateBucketIfNotExists(u32tob(seriesID))
+		if payloadLength > uint32(len(batch)) {
+			return nil, nil, ErrInvalidPointBuffer
+		}
+		data := batch[:payloadLength]
+		batch = batch[payloadLength:]
+
+		op := ShardWriteOp{Timestamp: timestamp, Tombstone: pointFlagIsTombstone(flags)}
+		if !op.Tombstone {
+			stored, err := encodeStoredPoint(flags, data)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
+			op.Data = stored
+		}
 
-			// Insert the values by timestamp.
-			if err := b.Put(u64tob(uint64(timestamp)), data); err != nil {
-				return err
-			}
+		if _, ok := grouped[seriesID]; !ok {
+			order = append(order, seriesID)
+		}
+		grouped[seriesID] = append(grouped[seriesID], op)
+	}
+	return order, grouped, nil
+}
 
-			// Push the buffer forward and check if we're done.
-			batch = batch[payloadLength:]
-			if len(batch) == 0 {
-				break
+// writeGroupedSeries applies ops already grouped by seriesID and advances
+// the shard's replicated index, all within one store transaction.
+func (s *Shard) writeGroupedSeries(index uint64, order []uint32, grouped map[uint32][]ShardWriteOp) error {
+	return s.store.Update(func(tx ShardTx) error {
+		for _, seriesID := range order {
+			if err := tx.PutSeriesPoints(seriesID, grouped[seriesID]); err != nil {
+				return err
 			}
 		}
 
 		// Set index.
-		if err := tx.Bucket([]byte("meta")).Put([]byte("index"), u64tob(index)); err != nil {
+		if err := tx.MetaPut("index", u64tob(index)); err != nil {
 			return fmt.Errorf("write shard index: %s", err)
 		}
 
@@ -187,16 +362,49 @@ func (s *Shard) writeSeries(index uint64, batch []byte) error {
 	})
 }
 
+// Point is a single already-parsed series point. It mirrors the
+// information carried by a point header and its payload, letting a caller
+// that already has parsed points skip the marshal/unmarshal round trip
+// writeSeries otherwise pays to parse a wire-format batch.
+type Point struct {
+	SeriesID  uint32
+	Timestamp int64
+	Data      []byte
+	Flags     uint8
+}
+
+// WriteSeriesBatch writes points directly to the shard, grouping them by
+// SeriesID the same way writeSeries does, without first marshaling them
+// into and back out of the wire batch format.
+func (s *Shard) WriteSeriesBatch(index uint64, points []Point) error {
+	var order []uint32
+	grouped := make(map[uint32][]ShardWriteOp)
+
+	for _, p := range points {
+		op := ShardWriteOp{Timestamp: p.Timestamp, Tombstone: pointFlagIsTombstone(p.Flags)}
+		if !op.Tombstone {
+			stored, err := encodeStoredPoint(p.Flags, p.Data)
+			if err != nil {
+				return err
+			}
+			op.Data = stored
+		}
+
+		if _, ok := grouped[p.SeriesID]; !ok {
+			order = append(order, p.SeriesID)
+		}
+		grouped[p.SeriesID] = append(grouped[p.SeriesID], op)
+	}
+
+	return s.writeGroupedSeries(index, order, grouped)
+}
+
 func (s *Shard) dropSeries(seriesID uint32) error {
 	if s.store == nil {
 		return nil
 	}
-	return s.store.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(u32tob(seriesID))
-		if err != bolt.ErrBucketNotFound {
-			return err
-		}
-		return nil
+	return s.store.Update(func(tx ShardTx) error {
+		return tx.DeleteSeries(seriesID)
 	})
 }
 
@@ -207,51 +415,60 @@ func (s *Shard) processor(conn MessagingConn) {
 		// Exit if the connection has been closed.
 		m, ok := <-conn.C()
 		if !ok {
+			close(s.pipeline.queue)
 			return
 		}
 
+		// Snapshot messages carry their own index semantics (a request
+		// references the requester's index, not this shard's) and are
+		// handled before the stale-index check below applies. They're
+		// handled inline, not through the write pipeline, since they're
+		// rare and shouldn't have to wait behind a coalescing window.
+		switch m.Type {
+		case snapshotRequestMessageType:
+			if err := s.handleSnapshotRequest(m, conn); err != nil {
+				panic(fmt.Errorf("snapshot request: id=%d, err=%s", s.ID, err))
+			}
+			continue
+		case snapshotChunkMessageType:
+			if err := s.handleSnapshotChunk(m); err != nil {
+				panic(fmt.Errorf("apply snapshot: id=%d, err=%s", s.ID, err))
+			}
+			continue
+		}
+
 		// Ignore any writes that are from an old index.
-		if m.Index < s.index {
+		if m.Index < s.loadIndex() {
 			continue
 		}
 
-		// Handle write series separately so we don't lock server during shard writes.
+		// Hand the message off to the write pipeline instead of applying
+		// it here, so a slow store commit can't stall reads from conn.C().
+		// s.index advances only once the pipeline actually commits it; see
+		// writePipeline.commit.
 		switch m.Type {
 		case writeRawSeriesMessageType:
-			if err := s.writeSeries(m.Index, m.Data); err != nil {
-				panic(fmt.Errorf("apply shard: id=%d, idx=%d, err=%s", s.ID, m.Index, err))
-			}
+			s.pipeline.queue <- m
 		default:
 			panic(fmt.Sprintf("invalid shard message type: %d", m.Type))
 		}
-
-		// Track last index.
-		s.index = m.Index
 	}
 }
 
+// Message types used for shard snapshot catch-up, handled by processor
+// alongside whatever message types the broker protocol already defines.
+const (
+	snapshotRequestMessageType = 100 + iota
+	snapshotChunkMessageType
+)
+
 // Shards represents a list of shards.
 type Shards []*Shard
 
-// pointHeaderSize represents the size of a point header, in bytes.
-const pointHeaderSize = 4 + 4 + 8 // seriesID + payload length + timestamp
-
-// marshalPointHeader encodes a series id, payload length, timestamp, & flagset into a byte slice.
-func marshalPointHeader(seriesID uint32, payloadLength uint32, timestamp int64) []byte {
-	b := make([]byte, pointHeaderSize)
-	binary.BigEndian.PutUint32(b[0:4], seriesID)
-	binary.BigEndian.PutUint32(b[4:8], payloadLength)
-	binary.BigEndian.PutUint64(b[8:16], uint64(timestamp))
-	return b
-}
-
-// unmarshalPointHeader decodes a byte slice into a series id, timestamp & flagset.
-func unmarshalPointHeader(b []byte) (seriesID uint32, payloadLength uint32, timestamp int64) {
-	seriesID = binary.BigEndian.Uint32(b[0:4])
-	payloadLength = binary.BigEndian.Uint32(b[4:8])
-	timestamp = int64(binary.BigEndian.Uint64(b[8:16]))
-	return
-}
+// pointHeaderSize represents the size of a point header, in bytes. The
+// format is seriesID(4) + payloadLength & flags packed into 4 bytes +
+// timestamp(8); see marshalPointHeader in point_header.go.
+const pointHeaderSize = 4 + 4 + 8 // seriesID + payload length/flags + timestamp
 
 type uint8Slice []uint8
 
@@ -0,0 +1,335 @@
+package influxdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Defaults for WritePipelineConfig, chosen so a shard backed by BoltDB's
+// fsync-per-commit latency can still keep up with a single broker's write
+// rate without letting the queue grow unbounded.
+const (
+	// DefaultWriteQueueDepth is how many broker messages processor buffers
+	// ahead of the write workers before it blocks reading from conn.C().
+	DefaultWriteQueueDepth = 1024
+
+	// DefaultWriteWorkers is the number of goroutines committing coalesced
+	// batches to the store.
+	DefaultWriteWorkers = 4
+
+	// DefaultCoalesceMaxBytes is the total payload size at which the
+	// dispatcher stops accumulating consecutive writeRawSeriesMessageType
+	// messages and hands what it has to a worker to commit.
+	DefaultCoalesceMaxBytes = 1 << 20 // 1MB
+
+	// DefaultCoalesceMaxDelay is the longest the dispatcher waits for more
+	// messages to coalesce before handing off a partial batch.
+	DefaultCoalesceMaxDelay = 10 * time.Millisecond
+
+	// DefaultErrorChannelDepth bounds how many unconsumed errors Errors()
+	// holds before a policy's caller is considered to have stopped
+	// draining it, at which point further errors are dropped rather than
+	// blocking the write workers.
+	DefaultErrorChannelDepth = 16
+)
+
+// WritePipelineConfig controls the bounded, asynchronous write path
+// between a shard's broker connection and its store. It is normally
+// set per Shard (Shard.PipelineConfig); ShardGroup has no pipeline
+// configuration of its own to pass down to its shards.
+type WritePipelineConfig struct {
+	// QueueDepth bounds how many broker messages processor may have
+	// buffered ahead of the write workers. Zero uses DefaultWriteQueueDepth.
+	QueueDepth int
+
+	// Workers is the number of goroutines draining the write queue and
+	// committing coalesced batches to the store. Zero uses
+	// DefaultWriteWorkers.
+	Workers int
+
+	// CoalesceMaxBytes is the total payload size at which the dispatcher
+	// stops coalescing and hands the batch off. Zero uses
+	// DefaultCoalesceMaxBytes.
+	CoalesceMaxBytes int
+
+	// CoalesceMaxDelay is the longest the dispatcher waits for more
+	// messages to coalesce before handing off a partial batch. Zero uses
+	// DefaultCoalesceMaxDelay.
+	CoalesceMaxDelay time.Duration
+
+	// OnWriteError decides how the pipeline reacts to a failed coalesced
+	// commit. Nil uses PanicWriteErrorPolicy, matching the shard's
+	// previous unconditional panic.
+	OnWriteError WriteErrorPolicy
+}
+
+// NewWritePipelineConfig returns a WritePipelineConfig using the package
+// defaults and PanicWriteErrorPolicy.
+func NewWritePipelineConfig() WritePipelineConfig {
+	return WritePipelineConfig{
+		QueueDepth:       DefaultWriteQueueDepth,
+		Workers:          DefaultWriteWorkers,
+		CoalesceMaxBytes: DefaultCoalesceMaxBytes,
+		CoalesceMaxDelay: DefaultCoalesceMaxDelay,
+		OnWriteError:     PanicWriteErrorPolicy,
+	}
+}
+
+// withDefaults returns a copy of cfg with every zero-valued field filled in
+// from NewWritePipelineConfig, so a caller only has to set the tunables it
+// means to override.
+func (cfg WritePipelineConfig) withDefaults() WritePipelineConfig {
+	d := NewWritePipelineConfig()
+	if cfg.QueueDepth > 0 {
+		d.QueueDepth = cfg.QueueDepth
+	}
+	if cfg.Workers > 0 {
+		d.Workers = cfg.Workers
+	}
+	if cfg.CoalesceMaxBytes > 0 {
+		d.CoalesceMaxBytes = cfg.CoalesceMaxBytes
+	}
+	if cfg.CoalesceMaxDelay > 0 {
+		d.CoalesceMaxDelay = cfg.CoalesceMaxDelay
+	}
+	if cfg.OnWriteError != nil {
+		d.OnWriteError = cfg.OnWriteError
+	}
+	return d
+}
+
+// WriteErrorAction tells a write worker how to proceed after OnWriteError
+// has handled a failed coalesced commit.
+type WriteErrorAction int
+
+const (
+	// WriteErrorPanic crashes the process, the shard's original behavior.
+	WriteErrorPanic WriteErrorAction = iota
+
+	// WriteErrorRetry redelivers the same batch to the worker after the
+	// backoff the policy returned, without advancing s.index.
+	WriteErrorRetry
+
+	// WriteErrorReadonly marks the shard read-only and drops the batch.
+	// s.index is not advanced, so a future restart replays the dropped
+	// batch from the broker log instead of silently losing it.
+	WriteErrorReadonly
+)
+
+// WriteErrorPolicy decides how the write pipeline reacts to a failed
+// coalesced commit. attempt is 1 on the first failure for a given batch and
+// increments on each subsequent WriteErrorRetry of the same batch. Every
+// invocation is also reported on Shard.Errors() before the policy runs, so
+// a caller observes failures even when the policy recovers from them.
+type WriteErrorPolicy func(err error, attempt int) (action WriteErrorAction, backoff time.Duration)
+
+// PanicWriteErrorPolicy reproduces the shard's original behavior of
+// crashing the process on any write error.
+func PanicWriteErrorPolicy(err error, attempt int) (WriteErrorAction, time.Duration) {
+	return WriteErrorPanic, 0
+}
+
+// RetryWriteErrorPolicy returns a WriteErrorPolicy that retries a failed
+// batch indefinitely, doubling its backoff from initial up to max on each
+// successive attempt.
+func RetryWriteErrorPolicy(initial, max time.Duration) WriteErrorPolicy {
+	return func(err error, attempt int) (WriteErrorAction, time.Duration) {
+		wait := initial
+		for i := 1; i < attempt && wait < max; i++ {
+			wait *= 2
+		}
+		if wait > max {
+			wait = max
+		}
+		return WriteErrorRetry, wait
+	}
+}
+
+// ReadonlyWriteErrorPolicy returns a WriteErrorPolicy that marks the shard
+// read-only on the first write error instead of crashing the process.
+func ReadonlyWriteErrorPolicy() WriteErrorPolicy {
+	return func(err error, attempt int) (WriteErrorAction, time.Duration) {
+		return WriteErrorReadonly, 0
+	}
+}
+
+// writeBatch is one or more coalesced writeRawSeriesMessageType messages
+// destined for a single store transaction. prevCommitted is closed once the
+// batch immediately before this one has committed (or been dropped under
+// WriteErrorReadonly), letting several workers hold batches at once
+// while still applying them to the store, and advancing
+// s.index, in the order they were coalesced.
+type writeBatch struct {
+	index         uint64
+	order         []uint32
+	grouped       map[uint32][]ShardWriteOp
+	prevCommitted <-chan struct{}
+	committed     chan struct{}
+}
+
+// writePipeline is the bounded queue and worker pool feeding a single
+// shard's store. It decouples reading from conn.C() from BoltDB's commit
+// latency: processor only has to hand a message to queue, not wait for it
+// to land on disk.
+//
+// A single dispatcher goroutine reads queue and decides batch boundaries,
+// so the order batches are handed their commit tokens always matches the
+// order messages were dequeued in. Workers then take those batches
+// concurrently, but each one blocks on its token until the batch
+// before it has actually committed, so store writes and s.index still
+// advance in dequeue order no matter which worker finishes first.
+type writePipeline struct {
+	cfg   WritePipelineConfig
+	queue chan *Message
+	jobs  chan *writeBatch
+	errCh chan error
+}
+
+// newWritePipeline returns a writePipeline for the given config.
+func newWritePipeline(cfg WritePipelineConfig) *writePipeline {
+	cfg = cfg.withDefaults()
+	return &writePipeline{
+		cfg:   cfg,
+		queue: make(chan *Message, cfg.QueueDepth),
+		jobs:  make(chan *writeBatch, cfg.Workers),
+		errCh: make(chan error, DefaultErrorChannelDepth),
+	}
+}
+
+// start launches the pipeline's single dispatcher and its worker pool, each
+// of which commits the batches the dispatcher hands it to s.
+func (p *writePipeline) start(s *Shard) {
+	go p.dispatch()
+	for i := 0; i < p.cfg.Workers; i++ {
+		go p.runWorker(s)
+	}
+}
+
+// dispatch is the pipeline's only reader of queue. Running coalesce and the
+// handing-out of commit tokens on a single goroutine is what keeps token
+// order matching dequeue order even though multiple workers commit
+// concurrently.
+func (p *writePipeline) dispatch() {
+	ready := make(chan struct{})
+	close(ready) // the first batch has nothing to wait on
+
+	for {
+		batch, ok := p.coalesce()
+		if !ok {
+			close(p.jobs)
+			return
+		}
+
+		batch.prevCommitted = ready
+		ready = batch.committed
+		p.jobs <- batch
+	}
+}
+
+// runWorker commits batches the dispatcher hands it until jobs is closed.
+func (p *writePipeline) runWorker(s *Shard) {
+	for batch := range p.jobs {
+		p.commit(s, batch)
+	}
+}
+
+// coalesce blocks for the first message, then keeps accumulating
+// consecutive messages already parsed and grouped by series until
+// CoalesceMaxBytes is reached or CoalesceMaxDelay has passed since the
+// first message. Only dispatch calls this.
+func (p *writePipeline) coalesce() (*writeBatch, bool) {
+	m, ok := <-p.queue
+	if !ok {
+		return nil, false
+	}
+
+	batch := &writeBatch{
+		order:     nil,
+		grouped:   make(map[uint32][]ShardWriteOp),
+		committed: make(chan struct{}),
+	}
+	p.mergeInto(batch, m)
+
+	deadline := time.NewTimer(p.cfg.CoalesceMaxDelay)
+	defer deadline.Stop()
+
+	size := len(m.Data)
+	for size < p.cfg.CoalesceMaxBytes {
+		select {
+		case m, ok := <-p.queue:
+			if !ok {
+				return batch, true
+			}
+			p.mergeInto(batch, m)
+			size += len(m.Data)
+		case <-deadline.C:
+			return batch, true
+		}
+	}
+	return batch, true
+}
+
+// mergeInto folds m's points into batch, preserving series order across
+// every message merged into the batch so far.
+func (p *writePipeline) mergeInto(batch *writeBatch, m *Message) {
+	batch.index = m.Index
+	order, grouped, err := groupBatchBySeries(m.Data)
+	if err != nil {
+		// A malformed batch can't be coalesced; report it and drop just
+		// this message's points rather than failing the whole batch.
+		p.reportError(err)
+		return
+	}
+	for _, seriesID := range order {
+		if _, ok := batch.grouped[seriesID]; !ok {
+			batch.order = append(batch.order, seriesID)
+		}
+		batch.grouped[seriesID] = append(batch.grouped[seriesID], grouped[seriesID]...)
+	}
+}
+
+// commit waits for the previous batch to finish, then applies batch to s
+// and advances s.index, retrying or escalating through cfg.OnWriteError on
+// failure. It always closes batch.committed before returning so the next
+// batch isn't stuck waiting forever.
+func (p *writePipeline) commit(s *Shard, batch *writeBatch) {
+	defer close(batch.committed)
+
+	<-batch.prevCommitted
+
+	if s.Readonly() {
+		p.reportError(fmt.Errorf("shard readonly, dropping batch: id=%d, idx=%d", s.ID, batch.index))
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := s.writeGroupedSeries(batch.index, batch.order, batch.grouped)
+		if err == nil {
+			s.setIndex(batch.index)
+			return
+		}
+
+		p.reportError(fmt.Errorf("commit batch: id=%d, idx=%d, err=%s", s.ID, batch.index, err))
+
+		action, backoff := p.cfg.OnWriteError(err, attempt)
+		switch action {
+		case WriteErrorRetry:
+			time.Sleep(backoff)
+			continue
+		case WriteErrorReadonly:
+			s.setReadonly(err)
+			return
+		default:
+			panic(fmt.Errorf("commit shard: id=%d, idx=%d, err=%s", s.ID, batch.index, err))
+		}
+	}
+}
+
+// reportError pushes err onto errCh, dropping it instead of blocking if no
+// one is currently draining Shard.Errors().
+func (p *writePipeline) reportError(err error) {
+	select {
+	case p.errCh <- err:
+	default:
+	}
+}
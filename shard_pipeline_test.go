@@ -0,0 +1,50 @@
+package influxdb
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestRetryWriteErrorPolicy_Backoff verifies the returned policy doubles
+// its backoff from initial on each successive attempt for the same batch,
+// capping at max instead of growing without bound.
+func TestRetryWriteErrorPolicy_Backoff(t *testing.T) {
+	policy := RetryWriteErrorPolicy(10*time.Millisecond, 100*time.Millisecond)
+	err := errors.New("disk full")
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{5, 100 * time.Millisecond}, // would be 160ms uncapped
+		{6, 100 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		action, backoff := policy(err, c.attempt)
+		if action != WriteErrorRetry {
+			t.Fatalf("attempt %d: action = %v, want WriteErrorRetry", c.attempt, action)
+		}
+		if backoff != c.want {
+			t.Errorf("attempt %d: backoff = %v, want %v", c.attempt, backoff, c.want)
+		}
+	}
+}
+
+// TestReadonlyWriteErrorPolicy verifies the policy always asks for the
+// shard to be marked read-only, regardless of attempt count.
+func TestReadonlyWriteErrorPolicy(t *testing.T) {
+	policy := ReadonlyWriteErrorPolicy()
+	action, backoff := policy(errors.New("disk full"), 1)
+	if action != WriteErrorReadonly {
+		t.Fatalf("action = %v, want WriteErrorReadonly", action)
+	}
+	if backoff != 0 {
+		t.Errorf("backoff = %v, want 0", backoff)
+	}
+}
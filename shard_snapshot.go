@@ -0,0 +1,138 @@
+package influxdb
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// snapshotCatchupBehindThreshold is how many indexes behind the broker's
+// tail a shard must be before open() bothers asking a peer for a snapshot
+// instead of just replaying the broker log from s.index.
+const snapshotCatchupBehindThreshold = 10000
+
+// snapshotTailReporter is implemented by a MessagingConn that can report
+// how far ahead the broker's log is, so a newly-added replica can tell
+// whether a full replay from index 0 would be expensive enough to prefer
+// snapshot catch-up. It's checked for with a type assertion so this package
+// doesn't need to own the MessagingConn interface definition.
+type snapshotTailReporter interface {
+	Tail() (uint64, error)
+}
+
+// snapshotSender is implemented by a MessagingConn that can address a
+// message directly to a peer, which is how a snapshot request and its
+// reply travel outside the normal broadcast broker log.
+type snapshotSender interface {
+	Send(m *Message) error
+}
+
+// Snapshot streams a consistent view of the shard's store to w and
+// returns the replicated index the snapshot was taken at. A peer that
+// restores from this stream (Restore) and then replays the broker log
+// starting at index+1 ends up with exactly the same state as this shard.
+func (s *Shard) Snapshot(w io.Writer) (index uint64, err error) {
+	if s.store == nil {
+		return 0, errShardNotOpen
+	}
+
+	// Capture the index before the dump so a snapshot is never reported as
+	// newer than the data it actually contains; s.index only ever
+	// advances, so at worst a concurrent write makes this snapshot
+	// slightly stale, which is corrected by replaying from index+1.
+	index = s.loadIndex()
+
+	if err := s.store.Snapshot(w); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// Restore atomically replaces the shard's store contents and meta index
+// with the snapshot read from r, as produced by Snapshot.
+func (s *Shard) Restore(r io.Reader) error {
+	if s.store == nil {
+		return errShardNotOpen
+	}
+
+	if err := s.store.Restore(r); err != nil {
+		return err
+	}
+
+	return s.store.View(func(tx ShardTx) error {
+		buf, err := tx.MetaGet("index")
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			s.setIndex(btou64(buf))
+		}
+
+		buf, err = tx.MetaGet(shardFormatVersionKey)
+		if err != nil {
+			return err
+		}
+		if len(buf) > 0 {
+			s.setFormatVersion(int(btou64(buf)))
+		}
+		return nil
+	})
+}
+
+// errShardNotOpen is returned by Snapshot and Restore when called before
+// the shard's store has been opened.
+var errShardNotOpen = errors.New("shard not open")
+
+// requestSnapshotCatchup asks conn's peer for a snapshot if this shard is
+// far enough behind the broker's tail, and if conn supports the optional
+// direct-messaging interfaces needed to do so. It never blocks waiting for
+// a reply: the reply, if any, arrives as a snapshotChunkMessageType message
+// and is applied by processor once normal streaming begins.
+func (s *Shard) requestSnapshotCatchup(conn MessagingConn) {
+	tails, ok := conn.(snapshotTailReporter)
+	if !ok {
+		return
+	}
+	sender, ok := conn.(snapshotSender)
+	if !ok {
+		return
+	}
+
+	tail, err := tails.Tail()
+	if err != nil || tail <= s.index || tail-s.index < snapshotCatchupBehindThreshold {
+		return
+	}
+
+	_ = sender.Send(&Message{Type: snapshotRequestMessageType, Index: s.index})
+}
+
+// handleSnapshotRequest replies with a snapshot of this shard, if this
+// shard actually has data at or above the requested index and conn
+// supports addressing a reply directly to the requesting peer.
+func (s *Shard) handleSnapshotRequest(m *Message, conn MessagingConn) error {
+	sender, ok := conn.(snapshotSender)
+	if !ok {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	index, err := s.Snapshot(&buf)
+	if err != nil {
+		return err
+	}
+	if index < m.Index {
+		// We're not ahead of the requester; nothing useful to send.
+		return nil
+	}
+
+	return sender.Send(&Message{Type: snapshotChunkMessageType, Index: index, Data: buf.Bytes()})
+}
+
+// handleSnapshotChunk applies an incoming snapshot chunk during catch-up.
+func (s *Shard) handleSnapshotChunk(m *Message) error {
+	if err := s.Restore(bytes.NewReader(m.Data)); err != nil {
+		return err
+	}
+	s.setIndex(m.Index)
+	return nil
+}
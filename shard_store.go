@@ -0,0 +1,147 @@
+package influxdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrShardTxNotWritable is returned by a write method called on a ShardTx
+// produced by the LSM engine's View, which checks for it explicitly.
+// boltShardTx does not return it: BoltDB rejects such a write on its own,
+// with bolt.ErrTxNotWritable.
+var ErrShardTxNotWritable = errors.New("shard tx is not writable")
+
+// Engine name constants used in shard storage configuration.
+const (
+	// BoltStoreEngine is the default, durable B+tree engine backed by BoltDB.
+	BoltStoreEngine = "bolt"
+
+	// LSMStoreEngine is an LSM-tree engine tuned for write-heavy workloads.
+	LSMStoreEngine = "lsm"
+)
+
+// DefaultStoreEngine is used when a shard group does not specify one.
+const DefaultStoreEngine = BoltStoreEngine
+
+// ShardStoreConfig holds the engine selection and engine-specific options
+// for a shard. It is set per Shard (Shard.StoreConfig); ShardGroup has no
+// store configuration of its own to pass down to its shards.
+type ShardStoreConfig struct {
+	// Engine is one of BoltStoreEngine or LSMStoreEngine.
+	Engine string
+
+	// LSM holds tunables that only apply when Engine == LSMStoreEngine.
+	LSM LSMOptions
+}
+
+// NewShardStoreConfig returns a ShardStoreConfig using the default engine
+// and default LSM tunables.
+func NewShardStoreConfig() ShardStoreConfig {
+	return ShardStoreConfig{
+		Engine: DefaultStoreEngine,
+		LSM:    NewLSMOptions(),
+	}
+}
+
+// ShardStore is the storage interface a Shard writes its series data
+// through. It exists so a shard group can choose a backend appropriate to
+// its retention policy (e.g. BoltDB for long-lived, infrequently written
+// data vs. an LSM tree for write-heavy, short-retention data) without the
+// rest of the Shard type knowing which one it's talking to.
+type ShardStore interface {
+	// Open opens or creates the store at path.
+	Open(path string) error
+
+	// Close releases any resources held by the store.
+	Close() error
+
+	// Update executes fn within a read-write transaction.
+	Update(fn func(tx ShardTx) error) error
+
+	// View executes fn within a read-only transaction.
+	View(fn func(tx ShardTx) error) error
+
+	// Snapshot writes a consistent dump of the entire store to w.
+	Snapshot(w io.Writer) error
+
+	// Restore atomically replaces the store's contents with the dump read
+	// from r, as produced by Snapshot.
+	Restore(r io.Reader) error
+}
+
+// ShardTx is a transaction against a ShardStore. All series data is keyed
+// by seriesID and timestamp; a small "meta" namespace keyed by string is
+// used for shard-level bookkeeping such as the replicated index.
+type ShardTx interface {
+	// PutSeriesPoint stores the encoded point data for seriesID at timestamp.
+	PutSeriesPoint(seriesID uint32, timestamp int64, data []byte) error
+
+	// PutSeriesPoints stores or deletes every op in points for seriesID,
+	// resolving seriesID's on-disk location once rather than once per op.
+	// Use this instead of repeated PutSeriesPoint/DeleteSeriesPoint calls
+	// whenever a batch already has several points grouped by series.
+	PutSeriesPoints(seriesID uint32, points []ShardWriteOp) error
+
+	// GetSeriesPoint retrieves the encoded point data for seriesID at
+	// timestamp. It returns a nil slice, nil error if no point exists.
+	GetSeriesPoint(seriesID uint32, timestamp int64) ([]byte, error)
+
+	// DeleteSeries removes all points stored for seriesID.
+	DeleteSeries(seriesID uint32) error
+
+	// DeleteSeriesPoint removes a single point at timestamp for seriesID.
+	DeleteSeriesPoint(seriesID uint32, timestamp int64) error
+
+	// MetaGet retrieves a shard-level metadata value.
+	MetaGet(key string) ([]byte, error)
+
+	// MetaPut sets a shard-level metadata value.
+	MetaPut(key string, value []byte) error
+}
+
+// ShardWriteOp is a single point write or delete, batched per series so a
+// ShardStore only has to resolve a series' on-disk location once per
+// group rather than once per point.
+type ShardWriteOp struct {
+	Timestamp int64
+
+	// Data is the encoded value to store. Ignored when Tombstone is true.
+	Data []byte
+
+	// Tombstone, if true, deletes whatever is stored at Timestamp instead
+	// of writing Data.
+	Tombstone bool
+}
+
+// ShardStoreStats exposes per-series storage information that the
+// compaction enforcement loop uses to decide when a series needs to be
+// rewritten into a denser encoding.
+type ShardStoreStats interface {
+	// SeriesIDs returns the set of series currently stored.
+	SeriesIDs() ([]uint32, error)
+
+	// SeriesSize returns the approximate number of bytes stored for seriesID.
+	SeriesSize(seriesID uint32) (int64, error)
+
+	// RewriteSeries rewrites all of seriesID's stored points into a denser
+	// encoding in place.
+	RewriteSeries(seriesID uint32) error
+
+	// SeriesPoints returns every stored, raw point for seriesID keyed by
+	// timestamp. It's used to migrate a series written under an older
+	// on-disk format.
+	SeriesPoints(seriesID uint32) (map[int64][]byte, error)
+}
+
+// newShardStore returns an unopened ShardStore for the named engine.
+func newShardStore(cfg ShardStoreConfig) (ShardStore, error) {
+	switch cfg.Engine {
+	case "", BoltStoreEngine:
+		return newBoltShardStore(), nil
+	case LSMStoreEngine:
+		return newLSMShardStore(cfg.LSM), nil
+	default:
+		return nil, fmt.Errorf("unknown shard store engine: %q", cfg.Engine)
+	}
+}
@@ -0,0 +1,73 @@
+package influxdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openBenchStore opens a ShardStore for engine in a fresh temp file and
+// returns it along with a cleanup func.
+func openBenchStore(b *testing.B, cfg ShardStoreConfig) (ShardStore, func()) {
+	b.Helper()
+
+	dir, err := os.MkdirTemp("", "shard-store-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	store, err := newShardStore(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := store.Open(filepath.Join(dir, "shard.db")); err != nil {
+		b.Fatal(err)
+	}
+
+	return store, func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// benchmarkShardStoreIngest measures throughput for writing a single batch
+// of points, one seriesID per point, all at distinct timestamps.
+func benchmarkShardStoreIngest(b *testing.B, cfg ShardStoreConfig, points int) {
+	store, cleanup := openBenchStore(b, cfg)
+	defer cleanup()
+
+	data := make([]byte, 32) // a typical small point payload
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Update(func(tx ShardTx) error {
+			for j := 0; j < points; j++ {
+				seriesID := uint32(j % 1000)
+				timestamp := int64(i*points + j)
+				if err := tx.PutSeriesPoint(seriesID, timestamp, data); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkShardStoreIngest_Bolt(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("points=%d", n), func(b *testing.B) {
+			benchmarkShardStoreIngest(b, ShardStoreConfig{Engine: BoltStoreEngine}, n)
+		})
+	}
+}
+
+func BenchmarkShardStoreIngest_LSM(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("points=%d", n), func(b *testing.B) {
+			benchmarkShardStoreIngest(b, ShardStoreConfig{Engine: LSMStoreEngine, LSM: NewLSMOptions()}, n)
+		})
+	}
+}
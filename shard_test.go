@@ -0,0 +1,69 @@
+package influxdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestShard_UpgradeFormat_LSM_NoDeadlock exercises upgradeFormat against the
+// LSM engine, whose Update takes an exclusive lock that SeriesPoints also
+// takes (for reading). upgradeFormat must fetch the points to migrate
+// before entering Update rather than from inside its callback, or this
+// deadlocks every LSM shard on open.
+func TestShard_UpgradeFormat_LSM_NoDeadlock(t *testing.T) {
+	store := newLSMShardStore(NewLSMOptions())
+	if err := store.Open(filepath.Join(t.TempDir(), "shard.lsm")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	const seriesID = uint32(3)
+	if err := store.Update(func(tx ShardTx) error {
+		for ts := int64(1); ts <= 3; ts++ {
+			if err := tx.PutSeriesPoint(seriesID, ts, []byte("raw")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	sh := newShard()
+	sh.store = store
+	sh.setFormatVersion(shardFormatVersionLegacy)
+
+	done := make(chan error, 1)
+	go func() { done <- sh.upgradeFormat() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("upgradeFormat deadlocked")
+	}
+
+	if got := sh.loadFormatVersion(); got != currentShardFormatVersion {
+		t.Fatalf("formatVersion = %d, want %d", got, currentShardFormatVersion)
+	}
+
+	points, err := store.SeriesPoints(seriesID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("got %d migrated points, want 3", len(points))
+	}
+	for ts, stored := range points {
+		raw, err := decodeStoredPoint(currentShardFormatVersion, stored)
+		if err != nil {
+			t.Fatalf("ts=%d: %s", ts, err)
+		}
+		if string(raw) != "raw" {
+			t.Fatalf("ts=%d: got raw=%q, want %q", ts, raw, "raw")
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package influxdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+// benchmarkWriteSeriesBatch measures writeSeries throughput for a batch of
+// batchPoints points spread evenly across seriesCount distinct series.
+func benchmarkWriteSeriesBatch(b *testing.B, seriesCount, batchPoints int) {
+	sh := newShard()
+	sh.StoreConfig = ShardStoreConfig{Engine: BoltStoreEngine}
+
+	dir := b.TempDir()
+	store, err := newShardStore(sh.StoreConfig)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := store.Open(dir + "/shard.db"); err != nil {
+		b.Fatal(err)
+	}
+	sh.store = store
+	defer sh.close()
+
+	data := make([]byte, 32)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var batch []byte
+		for j := 0; j < batchPoints; j++ {
+			hdr, err := marshalPointHeader(uint32(j%seriesCount), uint32(len(data)), int64(i*batchPoints+j), 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			batch = append(batch, hdr...)
+			batch = append(batch, data...)
+		}
+
+		if err := sh.writeSeries(uint64(i+1), batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkShardWriteSeries(b *testing.B) {
+	for _, n := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("series=%d", n), func(b *testing.B) {
+			benchmarkWriteSeriesBatch(b, n, n)
+		})
+	}
+}